@@ -0,0 +1,72 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// DeriveIP deterministically maps a MAC address to an IPv4 host address
+// within the argument subnet (in CIDR notation), the network and broadcast
+// addresses are never returned.
+//
+// The address is derived from the low 32 bits of the MAC address, therefore
+// devices with sequential MAC addresses are assigned sequential IP addresses
+// within the subnet size. See DeriveIPProbe() to handle collisions.
+func DeriveIP(mac net.HardwareAddr, subnet string) (net.IP, error) {
+	return DeriveIPProbe(mac, subnet, nil)
+}
+
+// DeriveIPProbe is like DeriveIP() but invokes the argument probe function,
+// if not nil, to check whether a candidate address is already in use (e.g. by
+// comparing it with the host address or with an ARP probe on bridged
+// networks), in which case the following ones in the subnet are tried.
+//
+// An error is returned if all subnet host addresses are in use.
+func DeriveIPProbe(mac net.HardwareAddr, subnet string, inUse func(net.IP) bool) (net.IP, error) {
+	if len(mac) != 6 {
+		return nil, errors.New("invalid MAC address")
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+
+	if err != nil {
+		return nil, err
+	}
+
+	network := ipNet.IP.To4()
+	ones, bits := ipNet.Mask.Size()
+
+	if network == nil || bits != 32 {
+		return nil, fmt.Errorf("invalid IPv4 subnet %s", subnet)
+	}
+
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("subnet %s has no host addresses", subnet)
+	}
+
+	// exclude network and broadcast addresses
+	hosts := uint64(1)<<(bits-ones) - 2
+	base := binary.BigEndian.Uint32(network)
+	off := uint64(binary.BigEndian.Uint32(mac[2:6])) % hosts
+
+	for i := uint64(0); i < hosts; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+1+uint32((off+i)%hosts))
+
+		if inUse == nil || !inUse(ip) {
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no available address in subnet %s", subnet)
+}
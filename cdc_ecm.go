@@ -9,21 +9,35 @@
 package usbnet
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/usbarmory/tamago/soc/nxp/usb"
 
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
 // NIC represents an virtual Ethernet instance.
 type NIC struct {
-	// Host MAC address
+	// Host MAC address, all transmitted frames are addressed to it as the
+	// link performs no address resolution (no ARP requests are issued,
+	// nor is the stack neighbor table used).
+	//
+	// This avoids any periodic re-resolution on the point-to-point link, at
+	// the cost of not detecting host MAC changes: if the host interface
+	// address changes, frames are discarded by the host until HostMAC is
+	// updated and the interface initialized again.
 	HostMAC net.HardwareAddr
 
 	// Device MAC address
@@ -35,6 +49,34 @@ type NIC struct {
 	// Device is the physical interface associated to the virtual one.
 	Device *usb.Device
 
+	// Profile is the USB descriptor profile, set by Init() to
+	// DefaultProfile if not already defined.
+	Profile *Profile
+
+	// ConfigurationIndex is the index of the device configuration
+	// populated by Init() (see ConfigureDeviceProfiles()).
+	ConfigurationIndex int
+
+	// LinkChange is an optional function invoked on link state changes,
+	// the link is up when the host activates the data interface (see
+	// ActiveAltSetting()).
+	//
+	// The function is invoked synchronously within the USB SETUP handler,
+	// it must therefore return promptly and never block (e.g. on network
+	// operations or channel sends) as the host expects control requests
+	// to be completed within a few milliseconds. Slow consumers should use
+	// LinkEvents() instead.
+	LinkChange func(up bool)
+
+	// StartDisabled leaves the NIC disabled after Init(), until Enable()
+	// is invoked (see ECMRx()).
+	StartDisabled bool
+
+	// Trace is an optional function invoked to log each control request,
+	// and the response given to it, to diagnose host enumeration issues.
+	// It is disabled by default due to its verbosity.
+	Trace TraceFunc
+
 	// Rx is endpoint 1 OUT function, set by Init() to ECMRx if not
 	// already defined.
 	Rx func([]byte, error) ([]byte, error)
@@ -49,6 +91,36 @@ type NIC struct {
 
 	maxPacketSize int
 	buf           []byte
+	tx            txQueue
+	raw           chan []byte
+	txBytes       atomic.Uint64
+
+	enabled       atomic.Bool
+	disabledDrops atomic.Uint64
+
+	dataInterface uint8
+	altSetting    atomic.Uint32
+	nextSetup     usb.SetupFunction
+	setupHook     uintptr
+
+	mu      sync.Mutex
+	events  chan bool
+	closed  bool
+	hostIP  net.IP
+	hostMAC net.HardwareAddr
+
+	policy        atomic.Pointer[SecurityPolicy]
+	securityDrops securityCounters
+
+	rxProtocols protocolCounters
+	txProtocols protocolCounters
+
+	etherTypePolicy atomic.Pointer[UnknownEtherTypePolicy]
+	etherTypes      etherTypeCounters
+
+	shaper shaper
+
+	mtuProbe atomic.Pointer[mtuProbe]
 }
 
 // Init initializes a virtual Ethernet instance on a specific USB device and
@@ -74,12 +146,188 @@ func (eth *NIC) Init() (err error) {
 		eth.Control = eth.ECMControl
 	}
 
+	if eth.Profile == nil {
+		eth.Profile = &DefaultProfile
+	}
+
+	if eth.ConfigurationIndex < 0 || eth.ConfigurationIndex >= len(eth.Device.Configurations) {
+		return errors.New("invalid configuration index")
+	}
+
+	eth.raw = make(chan []byte, QueueSize)
+	eth.enabled.Store(!eth.StartDisabled)
+
 	addControlInterface(eth.Device, eth)
 	addDataInterfaces(eth.Device, eth)
 
+	eth.nextSetup = eth.Device.Setup
+	eth.Device.Setup = eth.setup
+	eth.setupHook = reflect.ValueOf(eth.Device.Setup).Pointer()
+
+	return
+}
+
+// bmRequestType fields
+const (
+	requestTypeMask           = 0x60
+	requestTypeStandard       = 0x00
+	requestRecipientMask      = 0x1f
+	requestRecipientInterface = 0x01
+)
+
+// setup tracks host requests relevant to the virtual Ethernet instance,
+// before handing them over to any previously defined setup function and then
+// to the standard setup handlers.
+func (eth *NIC) setup(setup *usb.SetupData) (in []byte, ack bool, done bool, err error) {
+	// class and vendor requests can reuse standard bRequest codes (e.g.
+	// HID SET_REPORT), therefore only standard ones are tracked
+	if setup.RequestType&requestTypeMask == requestTypeStandard {
+		switch setup.Request {
+		case usb.SET_CONFIGURATION:
+			eth.setAltSetting(0)
+		case usb.SET_INTERFACE:
+			if setup.RequestType&requestRecipientMask == requestRecipientInterface &&
+				eth.configurationActive() && uint8(setup.Index) == eth.dataInterface {
+				eth.setAltSetting(uint8(setup.Value >> 8))
+			}
+		}
+	}
+
+	if eth.nextSetup != nil {
+		in, ack, done, err = eth.nextSetup(setup)
+	}
+
+	if eth.Trace != nil {
+		eth.trace(setup, in, ack, done, err)
+	}
+
 	return
 }
 
+// configurationActive returns whether the host selected the device
+// configuration associated to the virtual Ethernet instance.
+func (eth *NIC) configurationActive() bool {
+	conf := eth.Device.Configurations[eth.ConfigurationIndex]
+	return eth.Device.ConfigurationValue == conf.ConfigurationValue
+}
+
+// setAltSetting records the data interface alternate setting, notifying link
+// state changes.
+func (eth *NIC) setAltSetting(alt uint8) {
+	prev := eth.altSetting.Swap(uint32(alt))
+
+	if up := alt != 0; up != (prev != 0) {
+		eth.notify(up)
+	}
+}
+
+// notify delivers a link state change to the LinkChange function and to the
+// link events channel.
+func (eth *NIC) notify(up bool) {
+	if eth.LinkChange != nil {
+		eth.LinkChange(up)
+	}
+
+	eth.mu.Lock()
+	defer eth.mu.Unlock()
+
+	if eth.events == nil || eth.closed {
+		return
+	}
+
+	// coalesce events, the latest state wins
+	select {
+	case <-eth.events:
+	default:
+	}
+
+	eth.events <- up
+}
+
+// LinkUp returns whether the host activated the data interface.
+//
+// The link is tracked on host SET_CONFIGURATION and SET_INTERFACE requests,
+// as bus resets and disconnections are not visible to setup functions the
+// link remains up after the device is unplugged until the next
+// SET_CONFIGURATION request.
+func (eth *NIC) LinkUp() bool {
+	return eth.ActiveAltSetting() != 0
+}
+
+// LinkTracked returns whether the link state reported by LinkUp() can be
+// trusted, which requires the setup function installed by Init() to remain
+// the device one. This is not the case when the device Setup function is
+// replaced, or wrapped, after Init() (e.g. by composite device drivers).
+func (eth *NIC) LinkTracked() bool {
+	if eth.Device == nil || eth.Device.Setup == nil || eth.setupHook == 0 {
+		return false
+	}
+
+	return reflect.ValueOf(eth.Device.Setup).Pointer() == eth.setupHook
+}
+
+// LinkEvents returns a channel delivering link state changes (true when up,
+// false when down).
+//
+// The channel is buffered with a single slot, when the consumer is slow
+// pending events are coalesced and only the latest state is delivered. The
+// channel is closed on Close().
+func (eth *NIC) LinkEvents() <-chan bool {
+	eth.mu.Lock()
+	defer eth.mu.Unlock()
+
+	if eth.events == nil {
+		eth.events = make(chan bool, 1)
+
+		if eth.closed {
+			close(eth.events)
+		}
+	}
+
+	return eth.events
+}
+
+// Close closes the link events channel, if any.
+func (eth *NIC) Close() {
+	eth.mu.Lock()
+	defer eth.mu.Unlock()
+
+	if eth.events != nil && !eth.closed {
+		close(eth.events)
+	}
+
+	eth.closed = true
+}
+
+// ActiveAltSetting returns the data interface alternate setting selected by
+// the host, 0 signals a deactivated interface while 1 signals that the host
+// enabled data transfer.
+func (eth *NIC) ActiveAltSetting() uint8 {
+	return uint8(eth.altSetting.Load())
+}
+
+// Enable enables reception of frames from the host.
+func (eth *NIC) Enable() {
+	eth.enabled.Store(true)
+}
+
+// Disable disables reception of frames from the host, frames received while
+// disabled are dropped.
+func (eth *NIC) Disable() {
+	eth.enabled.Store(false)
+}
+
+// Enabled returns whether reception of frames from the host is enabled.
+func (eth *NIC) Enabled() bool {
+	return eth.enabled.Load()
+}
+
+// DisabledDrops returns the number of frames dropped as received while the
+// NIC was disabled.
+func (eth *NIC) DisabledDrops() uint64 {
+	return eth.disabledDrops.Load()
+}
+
 // ECMControl implements the endpoint 2 IN function.
 func (eth *NIC) ECMControl(_ []byte, lastErr error) (in []byte, err error) {
 	// ignore for now
@@ -88,6 +336,11 @@ func (eth *NIC) ECMControl(_ []byte, lastErr error) (in []byte, err error) {
 
 // ECMRx implements the endpoint 1 OUT function, used to receive Ethernet
 // packet from host to device.
+//
+// Frames received while the NIC is disabled (see StartDisabled and Disable())
+// are dropped, and counted (see DisabledDrops()), rather than buffered. USB
+// transfers are still accepted so that, once Enable() is invoked, reception
+// resumes with the first complete frame.
 func (eth *NIC) ECMRx(out []byte, lastErr error) (_ []byte, err error) {
 	if len(eth.buf) == 0 && len(out) < 14 {
 		return
@@ -100,10 +353,35 @@ func (eth *NIC) ECMRx(out []byte, lastErr error) (_ []byte, err error) {
 		return
 	}
 
+	if !eth.enabled.Load() {
+		eth.disabledDrops.Add(1)
+		eth.buf = []byte{}
+		return
+	}
+
+	if !eth.filter(eth.buf) {
+		eth.buf = []byte{}
+		return
+	}
+
+	eth.rxProtocols.count(eth.buf)
+
 	hdr := eth.buf[0:14]
 	proto := tcpip.NetworkProtocolNumber(binary.BigEndian.Uint16(eth.buf[12:14]))
 	payload := eth.buf[14:]
 
+	if !knownEtherType(proto) {
+		eth.handleUnknownEtherType(eth.buf)
+		eth.buf = []byte{}
+		return
+	}
+
+	eth.learn(eth.buf)
+
+	if probe := eth.mtuProbe.Load(); probe != nil {
+		probe.match(eth.buf)
+	}
+
 	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
 		ReserveHeaderBytes: len(hdr),
 		Payload:            buffer.MakeWithData(payload),
@@ -117,26 +395,171 @@ func (eth *NIC) ECMRx(out []byte, lastErr error) (_ []byte, err error) {
 	return
 }
 
-// ECMTx implements the endpoint 1 IN function, used to transmit Ethernet
-// packet from device to host.
-func (eth *NIC) ECMTx(_ []byte, lastErr error) (in []byte, err error) {
-	var pkt *stack.PacketBuffer
+// ReplayFrames injects the argument Ethernet frames through the Rx function,
+// as if they were received from the host, optionally waiting the argument
+// interval between each frame. Frames are injected verbatim, their EtherType
+// is therefore subject to the same handling as received ones (see
+// SetUnknownEtherTypePolicy()), see SendRaw() for the transmit direction.
+//
+// Frames are split in USB transfers of the endpoint maximum packet size, the
+// real USB layer is entirely bypassed. It is meant for debugging purposes, to
+// deterministically reproduce an input sequence, and should not be used while
+// the host is transmitting.
+func (eth *NIC) ReplayFrames(frames [][]byte, interval time.Duration) (err error) {
+	if eth.Rx == nil || eth.maxPacketSize == 0 {
+		return errors.New("NIC not initialized")
+	}
 
-	if pkt = eth.Link.Read(); pkt == nil {
-		return
+	for i, frame := range frames {
+		if len(frame) < 14 {
+			return fmt.Errorf("invalid frame %d, length %d", i, len(frame))
+		}
+	}
+
+	for i, frame := range frames {
+		if i > 0 && interval > 0 {
+			time.Sleep(interval)
+		}
+
+		for off := 0; ; off += eth.maxPacketSize {
+			end := min(off+eth.maxPacketSize, len(frame))
+
+			// a trailing zero length packet terminates frames
+			// which are a multiple of the maximum packet size
+			if _, err = eth.Rx(frame[off:end], nil); err != nil {
+				return
+			}
+
+			if end-off < eth.maxPacketSize {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// txBytesPollInterval represents the WaitTxBytes() polling interval.
+const txBytesPollInterval = 10 * time.Millisecond
+
+// TxBytes returns the number of bytes, in Ethernet frames, successfully
+// transmitted to the host. As the USB layer reports transfer results on the
+// following ECMTx() invocation, a frame is only accounted for once the next
+// one is requested.
+func (eth *NIC) TxBytes() uint64 {
+	return eth.txBytes.Load()
+}
+
+// WaitTxBytes blocks until at least n bytes have been transmitted to the host
+// (see TxBytes()), polling the counter, or until ctx is done in which case its
+// error is returned. It is meant for testing and diagnostic purposes.
+func (eth *NIC) WaitTxBytes(ctx context.Context, n uint64) error {
+	ticker := time.NewTicker(txBytesPollInterval)
+	defer ticker.Stop()
+
+	for eth.txBytes.Load() < n {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// SendRaw queues the argument Ethernet frame for transmission to the host,
+// bypassing the stack. The frame is transmitted exactly as passed, including
+// its addresses and EtherType, allowing injection of arbitrary protocols for
+// testing purposes.
+//
+// The frame must include a complete Ethernet header and not exceed the MTU,
+// an error is returned if the transmission queue (of QueueSize frames) is
+// full.
+func (eth *NIC) SendRaw(frame []byte) error {
+	if eth.raw == nil {
+		return errors.New("NIC not initialized")
+	}
+
+	if len(frame) < header.EthernetMinimumSize || len(frame) > header.EthernetMinimumSize+int(MTU) {
+		return fmt.Errorf("invalid frame length %d", len(frame))
 	}
 
+	select {
+	case eth.raw <- append([]byte{}, frame...):
+		return nil
+	default:
+		return errors.New("transmission queue full")
+	}
+}
+
+// frame returns the Ethernet frame for a stack originated packet, addressed
+// to the host with the EtherType derived from its network protocol.
+func (eth *NIC) frame(pkt *stack.PacketBuffer) (buf []byte) {
 	proto := make([]byte, 2)
 	binary.BigEndian.PutUint16(proto, uint16(pkt.NetworkProtocolNumber))
 
 	// Ethernet frame header
-	in = append(in, eth.HostMAC...)
-	in = append(in, eth.DeviceMAC...)
-	in = append(in, proto...)
+	buf = append(buf, eth.HostMAC...)
+	buf = append(buf, eth.DeviceMAC...)
+	buf = append(buf, proto...)
 
 	for _, v := range pkt.AsSlices() {
-		in = append(in, v...)
+		buf = append(buf, v...)
 	}
 
 	return
 }
+
+// ECMTx implements the endpoint 1 IN function, used to transmit Ethernet
+// packet from device to host.
+//
+// The USB layer transmits each returned frame atomically, as a single
+// transfer terminated by a short or zero length packet, and reports failures
+// on the following invocation. A frame whose transfer failed is retransmitted
+// once, in its entirety, rather than resumed. This cannot undo a partial
+// transfer already received by the host, which is left to discard the
+// truncated frame on its own validation (e.g. IP length checks).
+//
+// Raw frames (see SendRaw()) are transmitted as is, with priority over stack
+// originated packets. When a transmit rate is set (see SetTxRate()) frames
+// over budget are held and retried on the following invocations.
+func (eth *NIC) ECMTx(_ []byte, lastErr error) (in []byte, err error) {
+	in, sent := eth.tx.next(lastErr, eth.read, eth.admit)
+	eth.txBytes.Add(uint64(len(sent)))
+
+	return
+}
+
+// read returns the next frame to transmit, raw frames have priority over
+// stack originated packets.
+func (eth *NIC) read() []byte {
+	select {
+	case in := <-eth.raw:
+		return in
+	default:
+	}
+
+	if pkt := eth.Link.Read(); pkt != nil {
+		return eth.frame(pkt)
+	}
+
+	return nil
+}
+
+// admit returns whether a frame fits the transmit rate budget, accounting
+// for its transmission or deferral.
+func (eth *NIC) admit(frame []byte, held bool) bool {
+	if !eth.shaper.allow(len(frame)) {
+		if !held {
+			eth.shaper.deferredFrames.Add(1)
+			eth.shaper.deferredBytes.Add(uint64(len(frame)))
+		}
+
+		return false
+	}
+
+	eth.txProtocols.count(frame)
+
+	return true
+}
@@ -0,0 +1,98 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+)
+
+const (
+	testDeviceMAC = "1a:55:89:a2:69:41"
+	testHostMAC   = "1a:55:89:a2:69:42"
+)
+
+// newTestNIC returns a virtual Ethernet instance initialized on a new USB
+// device with a single configuration.
+func newTestNIC(t *testing.T) *NIC {
+	t.Helper()
+
+	hostMAC, _ := net.ParseMAC(testHostMAC)
+	deviceMAC, _ := net.ParseMAC(testDeviceMAC)
+
+	device := &usb.Device{}
+	ConfigureDevice(device, testDeviceMAC)
+
+	eth := &NIC{
+		HostMAC:   hostMAC,
+		DeviceMAC: deviceMAC,
+		Link:      channel.New(QueueSize, MTU, ""),
+		Device:    device,
+	}
+
+	if err := eth.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return eth
+}
+
+// setConfiguration simulates the host selecting the argument configuration,
+// including the update performed by the standard setup handler.
+func setConfiguration(eth *NIC, value uint8) {
+	eth.Device.Setup(&usb.SetupData{Request: usb.SET_CONFIGURATION, Value: uint16(value)})
+	eth.Device.ConfigurationValue = value
+}
+
+// setInterface simulates a request, of the argument bmRequestType and
+// bRequest, targeting the data interface with the argument value.
+func setInterface(eth *NIC, requestType uint8, request uint8, alt uint8) {
+	eth.Device.Setup(&usb.SetupData{
+		RequestType: requestType,
+		Request:     request,
+		Value:       uint16(alt) << 8,
+		Index:       uint16(eth.dataInterface),
+	})
+}
+
+func TestSetupLinkTracking(t *testing.T) {
+	eth := newTestNIC(t)
+
+	if eth.LinkUp() {
+		t.Fatal("link up before enumeration")
+	}
+
+	setConfiguration(eth, 1)
+	setInterface(eth, 0x01, usb.SET_INTERFACE, 1)
+
+	if !eth.LinkUp() {
+		t.Fatal("link down after SET_INTERFACE")
+	}
+
+	// HID SET_REPORT and SET_PROTOCOL share the SET_CONFIGURATION and
+	// SET_INTERFACE codes
+	setInterface(eth, 0x21, usb.SET_CONFIGURATION, 0)
+	setInterface(eth, 0x21, usb.SET_INTERFACE, 0)
+
+	// standard SET_INTERFACE with a device recipient
+	setInterface(eth, 0x00, usb.SET_INTERFACE, 0)
+
+	if !eth.LinkUp() {
+		t.Fatal("link down after non standard interface requests")
+	}
+
+	setConfiguration(eth, 1)
+
+	if eth.LinkUp() {
+		t.Fatal("link up after SET_CONFIGURATION")
+	}
+}
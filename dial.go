@@ -0,0 +1,269 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+)
+
+// DialPreference represents the address family selection policy for names
+// resolving to both IPv4 and IPv6 addresses.
+type DialPreference int
+
+const (
+	// PreferIPv4 attempts IPv4 addresses first, falling back to IPv6
+	// ones on failure.
+	PreferIPv4 DialPreference = iota
+	// PreferIPv6 attempts IPv6 addresses first, falling back to IPv4
+	// ones on failure.
+	PreferIPv6
+	// HappyEyeballs races interleaved IPv6 and IPv4 attempts, starting
+	// each one HappyEyeballsDelay after the previous one (or immediately
+	// on its failure), the first established connection wins (RFC 8305).
+	HappyEyeballs
+)
+
+// HappyEyeballsDelay represents the Connection Attempt Delay (p12, 5.
+// Establishing Connections, RFC 8305) used in HappyEyeballs mode.
+var HappyEyeballsDelay = 250 * time.Millisecond
+
+// dialResult represents a connection attempt outcome.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// SetDialPreference sets the address family selection policy used by
+// DialContext(), PreferIPv4 applies if never invoked.
+//
+// IPv6 addresses can only be reached on stacks configured with the IPv6
+// protocol (see DefaultStackOptions).
+func (iface *Interface) SetDialPreference(p DialPreference) error {
+	switch p {
+	case PreferIPv4, PreferIPv6, HappyEyeballs:
+	default:
+		return errors.New("invalid dial preference")
+	}
+
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+
+	iface.dialPreference = p
+
+	return nil
+}
+
+// sortAddresses orders the argument addresses according to the dial
+// preference, preserving the resolver order within each family.
+func sortAddresses(addrs []net.IP, p DialPreference) (sorted []net.IP) {
+	var v4, v6 []net.IP
+
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.To4())
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch p {
+	case PreferIPv6:
+		return append(v6, v4...)
+	case HappyEyeballs:
+		for i := 0; i < len(v4) || i < len(v6); i++ {
+			if i < len(v6) {
+				sorted = append(sorted, v6[i])
+			}
+
+			if i < len(v4) {
+				sorted = append(sorted, v4[i])
+			}
+		}
+
+		return
+	default:
+		return append(v4, v6...)
+	}
+}
+
+// dialIP connects to a TCP address through the stack.
+func (iface *Interface) dialIP(ctx context.Context, ip net.IP, port uint16) (net.Conn, error) {
+	proto := ipv6.ProtocolNumber
+
+	if ip.To4() != nil {
+		proto = ipv4.ProtocolNumber
+	}
+
+	addr := tcpip.FullAddress{Addr: tcpip.AddrFromSlice(ip), Port: port}
+
+	return gonet.DialContextTCP(ctx, iface.Stack, addr, proto)
+}
+
+// DialContext connects to a TCP address, with support for timeout supplied by
+// ctx, on the "tcp", "tcp4" or "tcp6" networks.
+//
+// ErrLinkDown is returned if the host has not activated the data interface.
+// The address host can be a literal IP address or, if LookupHost is set, a
+// name. Names resolving to multiple addresses are attempted according to the
+// dial preference (see SetDialPreference()).
+func (iface *Interface) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var addrs []net.IP
+
+	if iface.linkDown() {
+		return nil, ErrLinkDown
+	}
+
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = append(addrs, ip)
+	} else if iface.LookupHost != nil {
+		names, err := iface.LookupHost(ctx, host)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			if ip := net.ParseIP(name); ip != nil {
+				addrs = append(addrs, ip)
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("cannot resolve %q, missing LookupHost", host)
+	}
+
+	for i := 0; i < len(addrs); i++ {
+		v4 := addrs[i].To4() != nil
+
+		switch network {
+		case "tcp":
+			continue
+		case "tcp4":
+			if v4 {
+				continue
+			}
+		case "tcp6":
+			if !v4 {
+				continue
+			}
+		default:
+			return nil, fmt.Errorf("unsupported network %q", network)
+		}
+
+		addrs = append(addrs[:i], addrs[i+1:]...)
+		i--
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no %s address for %q", network, host)
+	}
+
+	iface.mu.Lock()
+	pref := iface.dialPreference
+	iface.mu.Unlock()
+
+	addrs = sortAddresses(addrs, pref)
+
+	if pref == HappyEyeballs {
+		return iface.dialRace(ctx, addrs, uint16(p))
+	}
+
+	var errs []error
+
+	for _, ip := range addrs {
+		conn, err := iface.dialIP(ctx, ip, uint16(p))
+
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dialRace races staggered connection attempts to the argument addresses,
+// returning the first established connection and closing any other.
+func (iface *Interface) dialRace(ctx context.Context, addrs []net.IP, port uint16) (net.Conn, error) {
+	var errs []error
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	pending := 0
+
+	for i := 0; i < len(addrs) || pending > 0; {
+		var delay <-chan time.Time
+
+		if i < len(addrs) {
+			go func(ip net.IP) {
+				conn, err := iface.dialIP(ctx, ip, port)
+				results <- dialResult{conn, err}
+			}(addrs[i])
+
+			i++
+			pending++
+		}
+
+		if i < len(addrs) {
+			delay = time.After(HappyEyeballsDelay)
+		}
+
+		select {
+		case r := <-results:
+			pending--
+
+			if r.err != nil {
+				errs = append(errs, r.err)
+				continue
+			}
+
+			// release losing attempts established meanwhile
+			go func(n int) {
+				for ; n > 0; n-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(pending)
+
+			return r.conn, nil
+		case <-delay:
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
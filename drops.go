@@ -0,0 +1,120 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"time"
+)
+
+// StackDropsInterval represents the default WatchStackDrops() polling
+// interval.
+var StackDropsInterval = 1 * time.Second
+
+// StackDropStats represents the gVisor stack packet drop counters, as opposed
+// to the ones maintained by the driver (see NIC.SecurityStats(),
+// NIC.UnknownEtherTypeStats(), Interface.QueueStats()).
+type StackDropStats struct {
+	// Dropped packets, before reaching any protocol, across all NICs
+	// (tcpip.Stats.DroppedPackets).
+	Dropped uint64
+
+	// IP packets dropped as malformed (IP.MalformedPacketsReceived),
+	// with an invalid destination (IP.InvalidDestinationAddressesReceived,
+	// e.g. not addressed to the device or without route) or source
+	// (IP.InvalidSourceAddressesReceived) address.
+	IPMalformed          uint64
+	IPInvalidDestination uint64
+	IPInvalidSource      uint64
+
+	// IP packets which could not be transmitted (IP.OutgoingPacketErrors).
+	IPOutgoingErrors uint64
+
+	// TCP segments dropped due to bad checksums (TCP.ChecksumErrors) or
+	// otherwise invalid (TCP.InvalidSegmentsReceived).
+	TCPChecksumErrors  uint64
+	TCPInvalidSegments uint64
+
+	// UDP datagrams dropped due to bad checksums (UDP.ChecksumErrors), as
+	// malformed (UDP.MalformedPacketsReceived), for lack of listener
+	// (UDP.UnknownPortErrors) or of receive buffer space
+	// (UDP.ReceiveBufferErrors).
+	UDPChecksumErrors uint64
+	UDPMalformed      uint64
+	UDPUnknownPort    uint64
+	UDPReceiveBuffer  uint64
+}
+
+// sub returns the counter differences between s and prev.
+func (s StackDropStats) sub(prev StackDropStats) StackDropStats {
+	return StackDropStats{
+		Dropped:              s.Dropped - prev.Dropped,
+		IPMalformed:          s.IPMalformed - prev.IPMalformed,
+		IPInvalidDestination: s.IPInvalidDestination - prev.IPInvalidDestination,
+		IPInvalidSource:      s.IPInvalidSource - prev.IPInvalidSource,
+		IPOutgoingErrors:     s.IPOutgoingErrors - prev.IPOutgoingErrors,
+		TCPChecksumErrors:    s.TCPChecksumErrors - prev.TCPChecksumErrors,
+		TCPInvalidSegments:   s.TCPInvalidSegments - prev.TCPInvalidSegments,
+		UDPChecksumErrors:    s.UDPChecksumErrors - prev.UDPChecksumErrors,
+		UDPMalformed:         s.UDPMalformed - prev.UDPMalformed,
+		UDPUnknownPort:       s.UDPUnknownPort - prev.UDPUnknownPort,
+		UDPReceiveBuffer:     s.UDPReceiveBuffer - prev.UDPReceiveBuffer,
+	}
+}
+
+// StackDrops returns the cumulative gVisor stack packet drop counters, as the
+// stack can be shared they are not specific to the interface.
+func (iface *Interface) StackDrops() StackDropStats {
+	stats := iface.Stack.Stats()
+
+	return StackDropStats{
+		Dropped:              stats.DroppedPackets.Value(),
+		IPMalformed:          stats.IP.MalformedPacketsReceived.Value(),
+		IPInvalidDestination: stats.IP.InvalidDestinationAddressesReceived.Value(),
+		IPInvalidSource:      stats.IP.InvalidSourceAddressesReceived.Value(),
+		IPOutgoingErrors:     stats.IP.OutgoingPacketErrors.Value(),
+		TCPChecksumErrors:    stats.TCP.ChecksumErrors.Value(),
+		TCPInvalidSegments:   stats.TCP.InvalidSegmentsReceived.Value(),
+		UDPChecksumErrors:    stats.UDP.ChecksumErrors.Value(),
+		UDPMalformed:         stats.UDP.MalformedPacketsReceived.Value(),
+		UDPUnknownPort:       stats.UDP.UnknownPortErrors.Value(),
+		UDPReceiveBuffer:     stats.UDP.ReceiveBufferErrors.Value(),
+	}
+}
+
+// WatchStackDrops polls the stack drop counters (see StackDrops()), until ctx
+// is cancelled, at the argument interval (StackDropsInterval if zero). The
+// argument function is invoked with the counter increments since the
+// previous poll, only when any occurred.
+func (iface *Interface) WatchStackDrops(ctx context.Context, interval time.Duration, fn func(StackDropStats)) error {
+	if interval <= 0 {
+		interval = StackDropsInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev := iface.StackDrops()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		curr := iface.StackDrops()
+
+		if delta := curr.sub(prev); delta != (StackDropStats{}) {
+			fn(delta)
+		}
+
+		prev = curr
+	}
+}
@@ -0,0 +1,135 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// EtherTypeAction represents the action taken on received frames carrying an
+// EtherType not handled by the stack (i.e. other than IPv4, IPv6 and ARP).
+type EtherTypeAction int
+
+const (
+	// DropEtherType drops the frame (default).
+	DropEtherType EtherTypeAction = iota
+	// ForwardEtherType writes the frame to the policy Sink.
+	ForwardEtherType
+	// CallbackEtherType invokes the policy Handler with the frame.
+	CallbackEtherType
+)
+
+// UnknownEtherTypePolicy represents the handling of received frames carrying
+// an EtherType not handled by the stack.
+//
+// Both the Sink Write() method and the Handler function are invoked
+// synchronously within the USB OUT endpoint function, they must therefore
+// return promptly and never block (e.g. on network operations or unbuffered
+// channel sends) as the reception of all frames, including the stack ones, is
+// held until they return. Slow consumers should copy frames to their own
+// goroutine.
+type UnknownEtherTypePolicy struct {
+	// Action is the action taken on unknown EtherType frames.
+	Action EtherTypeAction
+
+	// Sink receives the full Ethernet frames with ForwardEtherType.
+	Sink io.Writer
+
+	// Handler is invoked with the full Ethernet frames with
+	// CallbackEtherType, it must not retain the frame after returning.
+	Handler func(frame []byte)
+}
+
+// UnknownEtherTypeStats represents the number of received unknown EtherType
+// frames for each action taken.
+type UnknownEtherTypeStats struct {
+	Dropped   uint64
+	Forwarded uint64
+	Handled   uint64
+}
+
+type etherTypeCounters struct {
+	dropped   atomic.Uint64
+	forwarded atomic.Uint64
+	handled   atomic.Uint64
+}
+
+// knownEtherType returns whether frames of the argument EtherType are handled
+// by the stack.
+func knownEtherType(proto tcpip.NetworkProtocolNumber) bool {
+	switch proto {
+	case header.IPv4ProtocolNumber, header.IPv6ProtocolNumber, header.ARPProtocolNumber:
+		return true
+	}
+
+	return false
+}
+
+// SetUnknownEtherTypePolicy configures the handling of received frames
+// carrying an EtherType not handled by the stack.
+func (eth *NIC) SetUnknownEtherTypePolicy(policy UnknownEtherTypePolicy) error {
+	switch policy.Action {
+	case DropEtherType:
+	case ForwardEtherType:
+		if policy.Sink == nil {
+			return errors.New("missing sink")
+		}
+	case CallbackEtherType:
+		if policy.Handler == nil {
+			return errors.New("missing handler")
+		}
+	default:
+		return errors.New("invalid action")
+	}
+
+	eth.etherTypePolicy.Store(&policy)
+
+	return nil
+}
+
+// UnknownEtherTypeStats returns the number of received unknown EtherType
+// frames for each action taken.
+func (eth *NIC) UnknownEtherTypeStats() UnknownEtherTypeStats {
+	return UnknownEtherTypeStats{
+		Dropped:   eth.etherTypes.dropped.Load(),
+		Forwarded: eth.etherTypes.forwarded.Load(),
+		Handled:   eth.etherTypes.handled.Load(),
+	}
+}
+
+// handleUnknownEtherType applies the unknown EtherType policy to a received
+// frame.
+func (eth *NIC) handleUnknownEtherType(frame []byte) {
+	policy := eth.etherTypePolicy.Load()
+
+	if policy == nil {
+		eth.etherTypes.dropped.Add(1)
+		return
+	}
+
+	switch policy.Action {
+	case ForwardEtherType:
+		if _, err := policy.Sink.Write(frame); err != nil {
+			eth.etherTypes.dropped.Add(1)
+			return
+		}
+
+		eth.etherTypes.forwarded.Add(1)
+	case CallbackEtherType:
+		policy.Handler(frame)
+		eth.etherTypes.handled.Add(1)
+	default:
+		eth.etherTypes.dropped.Add(1)
+	}
+}
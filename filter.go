@@ -0,0 +1,137 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// SecurityPolicy represents the ingress filtering applied by ECMRx on frames
+// received from the host, its zero value is permissive.
+type SecurityPolicy struct {
+	// AllowedSourceMACs restricts received frames to the listed source MAC
+	// addresses, any source is accepted when empty.
+	AllowedSourceMACs []net.HardwareAddr
+
+	// SourceSubnet restricts received IPv4 packets, and ARP packets, to
+	// sender addresses within the subnet, any sender is accepted when nil.
+	// ARP probes (unspecified sender address) are always accepted.
+	// IPv6 packets are not restricted.
+	SourceSubnet *net.IPNet
+
+	// FilterDestinationMAC restricts received frames to the ones
+	// addressed to the device MAC, or to broadcast and multicast MACs.
+	FilterDestinationMAC bool
+}
+
+// SecurityStats represents the number of received frames dropped by each
+// SecurityPolicy category.
+type SecurityStats struct {
+	SourceMAC      uint64
+	SourceIP       uint64
+	DestinationMAC uint64
+}
+
+type securityCounters struct {
+	sourceMAC      atomic.Uint64
+	sourceIP       atomic.Uint64
+	destinationMAC atomic.Uint64
+}
+
+// SetSecurityPolicy configures the ingress filtering applied on received
+// frames.
+func (eth *NIC) SetSecurityPolicy(policy SecurityPolicy) error {
+	for _, mac := range policy.AllowedSourceMACs {
+		if len(mac) != 6 {
+			return errors.New("invalid MAC address")
+		}
+	}
+
+	if policy.SourceSubnet != nil && policy.SourceSubnet.IP.To4() == nil {
+		return errors.New("invalid source subnet")
+	}
+
+	eth.policy.Store(&policy)
+
+	return nil
+}
+
+// SecurityStats returns the number of received frames dropped by the
+// security policy.
+func (eth *NIC) SecurityStats() SecurityStats {
+	return SecurityStats{
+		SourceMAC:      eth.securityDrops.sourceMAC.Load(),
+		SourceIP:       eth.securityDrops.sourceIP.Load(),
+		DestinationMAC: eth.securityDrops.destinationMAC.Load(),
+	}
+}
+
+// filter applies the security policy to a received Ethernet frame, it
+// returns false if the frame must be dropped.
+func (eth *NIC) filter(frame []byte) bool {
+	policy := eth.policy.Load()
+
+	if policy == nil {
+		return true
+	}
+
+	dst := frame[0:6]
+	src := frame[6:12]
+
+	if policy.FilterDestinationMAC && !bytes.Equal(dst, eth.DeviceMAC) && dst[0]&0x01 == 0 {
+		eth.securityDrops.destinationMAC.Add(1)
+		return false
+	}
+
+	if len(policy.AllowedSourceMACs) > 0 {
+		allowed := false
+
+		for _, mac := range policy.AllowedSourceMACs {
+			if bytes.Equal(src, mac) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			eth.securityDrops.sourceMAC.Add(1)
+			return false
+		}
+	}
+
+	if policy.SourceSubnet != nil {
+		var ip net.IP
+
+		payload := frame[14:]
+
+		switch binary.BigEndian.Uint16(frame[12:14]) {
+		case uint16(header.IPv4ProtocolNumber):
+			if len(payload) >= header.IPv4MinimumSize {
+				ip = net.IP(header.IPv4(payload).SourceAddressSlice())
+			}
+		case uint16(header.ARPProtocolNumber):
+			if len(payload) >= header.ARPSize {
+				ip = net.IP(header.ARP(payload).ProtocolAddressSender())
+			}
+		}
+
+		if ip != nil && !ip.IsUnspecified() && !policy.SourceSubnet.Contains(ip) {
+			eth.securityDrops.sourceIP.Add(1)
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,79 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultHostnamePrefix represents the prefix of hostnames generated for
+// interfaces without an explicitly set one.
+var DefaultHostnamePrefix = "usbnet"
+
+// validHostname validates a hostname according to RFC 1123.
+func validHostname(name string) error {
+	if len(name) == 0 || len(name) > 253 {
+		return fmt.Errorf("invalid hostname length (%d)", len(name))
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("invalid hostname label length (%d)", len(label))
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid hostname label %q", label)
+		}
+
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			default:
+				return fmt.Errorf("invalid hostname character %q", c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetHostname sets the device hostname, used by service advertisement
+// features, which must be valid according to RFC 1123.
+func (iface *Interface) SetHostname(name string) error {
+	if err := validHostname(name); err != nil {
+		return err
+	}
+
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+
+	iface.hostname = name
+
+	return nil
+}
+
+// Hostname returns the device hostname, if not previously set a name is
+// generated from DefaultHostnamePrefix and the device MAC address.
+func (iface *Interface) Hostname() string {
+	iface.mu.Lock()
+	defer iface.mu.Unlock()
+
+	if iface.hostname != "" {
+		return iface.hostname
+	}
+
+	if iface.NIC == nil || len(iface.NIC.DeviceMAC) != 6 {
+		return DefaultHostnamePrefix
+	}
+
+	mac := iface.NIC.DeviceMAC
+
+	return fmt.Sprintf("%s-%02x%02x%02x", DefaultHostnamePrefix, mac[3], mac[4], mac[5])
+}
@@ -0,0 +1,152 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// IPv4 option types (p15, 3.1 Internet Header Format, RFC 791)
+const (
+	IPv4OptionEnd         = 0
+	IPv4OptionNOP         = 1
+	IPv4OptionRecordRoute = 7
+	IPv4OptionTimestamp   = 68
+	IPv4OptionRouterAlert = 148
+)
+
+// IPv4Option represents an IPv4 header option, single byte options (End of
+// Option List and No Operation) carry no data while the length field of all
+// others is derived from their data.
+type IPv4Option struct {
+	Type uint8
+	Data []byte
+}
+
+// RecordRouteOption returns a Record Route option (RFC 791) with room for the
+// argument number of addresses.
+func RecordRouteOption(slots int) IPv4Option {
+	// pointer to the first slot
+	data := make([]byte, 1+slots*net.IPv4len)
+	data[0] = 4
+
+	return IPv4Option{Type: IPv4OptionRecordRoute, Data: data}
+}
+
+// TimestampOption returns a Timestamp option (RFC 791), of the timestamps
+// only flavour, with room for the argument number of timestamps.
+func TimestampOption(slots int) IPv4Option {
+	// pointer to the first slot, overflow and flag (timestamps only)
+	data := make([]byte, 2+slots*4)
+	data[0] = 5
+
+	return IPv4Option{Type: IPv4OptionTimestamp, Data: data}
+}
+
+// RouterAlertOption returns a Router Alert option (RFC 2113).
+func RouterAlertOption() IPv4Option {
+	return IPv4Option{Type: IPv4OptionRouterAlert, Data: []byte{0, 0}}
+}
+
+// serializeIPv4Options validates and serializes the argument options, padded
+// to a 32-bit boundary.
+func serializeIPv4Options(opts []IPv4Option) (buf []byte, err error) {
+	for i, opt := range opts {
+		switch opt.Type {
+		case IPv4OptionEnd, IPv4OptionNOP:
+			if len(opt.Data) != 0 {
+				return nil, fmt.Errorf("option %d, type %d cannot carry data", i, opt.Type)
+			}
+
+			buf = append(buf, opt.Type)
+			continue
+		case IPv4OptionRecordRoute:
+			if len(opt.Data) < 1+net.IPv4len || (len(opt.Data)-1)%net.IPv4len != 0 || opt.Data[0] < 4 {
+				return nil, fmt.Errorf("option %d, invalid record route", i)
+			}
+		case IPv4OptionTimestamp:
+			if len(opt.Data) < 2+4 || opt.Data[0] < 5 {
+				return nil, fmt.Errorf("option %d, invalid timestamp", i)
+			}
+		}
+
+		if 2+len(opt.Data) > header.IPv4MaximumOptionsSize {
+			return nil, fmt.Errorf("option %d, invalid length", i)
+		}
+
+		buf = append(buf, opt.Type, uint8(2+len(opt.Data)))
+		buf = append(buf, opt.Data...)
+	}
+
+	// pad with End of Option List
+	for len(buf)%4 != 0 {
+		buf = append(buf, IPv4OptionEnd)
+	}
+
+	if len(buf) > header.IPv4MaximumOptionsSize {
+		return nil, fmt.Errorf("options size %d exceeds %d", len(buf), header.IPv4MaximumOptionsSize)
+	}
+
+	return
+}
+
+// SendIPv4WithOptions transmits an IPv4 packet, carrying the argument options
+// and transport protocol payload, bypassing the stack network layer. The
+// payload must be complete, including the transport header and checksum (e.g.
+// an ICMP echo request), which are not affected by header options.
+//
+// It is meant for diagnostic and research purposes, to test host handling of
+// options. The Record Route, Timestamp and Router Alert options are validated
+// before transmission, as well as processed by the stack, when reflected in
+// replies (e.g. by Linux hosts in ICMP echo replies). Other options are sent
+// as is and most hosts support few, if any, of them.
+func (iface *Interface) SendIPv4WithOptions(host string, protocol tcpip.TransportProtocolNumber, payload []byte, opts []IPv4Option) error {
+	dst := net.ParseIP(host).To4()
+
+	if dst == nil {
+		return fmt.Errorf("invalid IPv4 address %q", host)
+	}
+
+	options, err := serializeIPv4Options(opts)
+
+	if err != nil {
+		return err
+	}
+
+	hdrLen := header.IPv4MinimumSize + len(options)
+	length := hdrLen + len(payload)
+
+	if length > int(iface.Link.MTU()) {
+		return errors.New("packet exceeds MTU")
+	}
+
+	pkt := make([]byte, length)
+
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(length),
+		TTL:         iface.defaultTTL(),
+		Protocol:    uint8(protocol),
+		SrcAddr:     iface.addr,
+		DstAddr:     tcpip.AddrFromSlice(dst),
+	})
+	ip.SetHeaderLength(uint8(hdrLen))
+
+	copy(pkt[header.IPv4MinimumSize:], options)
+	copy(pkt[hdrLen:], payload)
+
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	return iface.writeIPv4(pkt)
+}
@@ -0,0 +1,213 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// QueuePolicy represents the behavior applied when the link outbound queue is
+// full.
+type QueuePolicy int
+
+const (
+	// DropNewest drops packets which do not fit the queue (default).
+	DropNewest QueuePolicy = iota
+	// DropOldest drops the oldest queued packet to make room for new
+	// ones.
+	DropOldest
+	// Block waits, up to the configured timeout, for the queue to be
+	// drained before dropping the packet.
+	//
+	// The wait happens synchronously on the sending goroutine, which the
+	// stack may invoke with transport endpoint locks held, therefore it
+	// stalls stack processing for its duration and its timeout is
+	// limited to MaxBlockTimeout.
+	Block
+)
+
+// MaxBlockTimeout represents the maximum timeout for the Block policy.
+const MaxBlockTimeout = 10 * time.Millisecond
+
+// queuePollInterval represents the queue polling interval for the Block
+// policy.
+const queuePollInterval = 100 * time.Microsecond
+
+// QueueStats represents the link outbound queue counters.
+type QueueStats struct {
+	// Enqueued is the number of packets queued for transmission.
+	Enqueued uint64
+	// DroppedNewest is the number of packets dropped as they did not fit
+	// the queue (DropNewest, or Block on timeout).
+	DroppedNewest uint64
+	// DroppedOldest is the number of queued packets dropped to make room
+	// for new ones (DropOldest).
+	DroppedOldest uint64
+	// Blocked is the number of packets which waited for queue room
+	// (Block).
+	Blocked uint64
+	// TimedOut is the number of packets dropped after waiting for queue
+	// room (Block).
+	TimedOut uint64
+}
+
+// linkEndpoint wraps a gVisor channel endpoint to manage its enqueue path.
+type linkEndpoint struct {
+	*channel.Endpoint
+
+	mu      sync.Mutex
+	policy  QueuePolicy
+	timeout time.Duration
+
+	enqueued      atomic.Uint64
+	droppedNewest atomic.Uint64
+	droppedOldest atomic.Uint64
+	blocked       atomic.Uint64
+	timedOut      atomic.Uint64
+}
+
+func newLinkEndpoint(ep *channel.Endpoint) *linkEndpoint {
+	return &linkEndpoint{
+		Endpoint: ep,
+	}
+}
+
+// write attempts to enqueue a single packet.
+func (e *linkEndpoint) write(pkt *stack.PacketBuffer) (bool, tcpip.Error) {
+	var pkts stack.PacketBufferList
+
+	pkts.PushBack(pkt)
+	n, err := e.Endpoint.WritePackets(pkts)
+
+	return n == 1, err
+}
+
+// WritePackets implements stack.LinkEndpoint.WritePackets.
+func (e *linkEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	n := 0
+
+	e.mu.Lock()
+	policy := e.policy
+	timeout := e.timeout
+	e.mu.Unlock()
+
+	for _, pkt := range pkts.AsSlice() {
+		ok, err := e.write(pkt)
+
+		if err != nil {
+			if n == 0 {
+				return 0, err
+			}
+
+			break
+		}
+
+		switch {
+		case ok:
+		case policy == DropOldest:
+			for !ok && err == nil {
+				if old := e.Endpoint.Read(); old != nil {
+					old.DecRef()
+					e.droppedOldest.Add(1)
+				}
+
+				ok, err = e.write(pkt)
+			}
+		case policy == Block:
+			e.blocked.Add(1)
+			deadline := time.Now().Add(timeout)
+
+			for !ok && err == nil && time.Now().Before(deadline) {
+				time.Sleep(queuePollInterval)
+				ok, err = e.write(pkt)
+			}
+
+			if !ok && err == nil {
+				e.timedOut.Add(1)
+			}
+		}
+
+		if !ok {
+			// the stack discards all remaining packets
+			e.droppedNewest.Add(uint64(pkts.Len() - n))
+			break
+		}
+
+		e.enqueued.Add(1)
+		n++
+	}
+
+	return n, nil
+}
+
+// SetQueuePolicy configures the behavior applied when the link outbound queue
+// is full, the timeout is only relevant for the Block policy.
+func (iface *Interface) SetQueuePolicy(policy QueuePolicy, timeout time.Duration) error {
+	switch policy {
+	case DropNewest, DropOldest:
+	case Block:
+		if timeout <= 0 || timeout > MaxBlockTimeout {
+			return errors.New("invalid timeout")
+		}
+	default:
+		return errors.New("invalid queue policy")
+	}
+
+	if iface.linkEP == nil {
+		return errors.New("interface not initialized")
+	}
+
+	iface.linkEP.mu.Lock()
+	defer iface.linkEP.mu.Unlock()
+
+	iface.linkEP.policy = policy
+	iface.linkEP.timeout = timeout
+
+	return nil
+}
+
+// QueueStats returns the link outbound queue counters.
+func (iface *Interface) QueueStats() (stats QueueStats) {
+	if e := iface.linkEP; e != nil {
+		stats = QueueStats{
+			Enqueued:      e.enqueued.Load(),
+			DroppedNewest: e.droppedNewest.Load(),
+			DroppedOldest: e.droppedOldest.Load(),
+			Blocked:       e.blocked.Load(),
+			TimedOut:      e.timedOut.Load(),
+		}
+	}
+
+	return
+}
+
+// LinkDrops returns the number of outbound packets dropped due to the link
+// queue being full, regardless of the queue policy. A rising value signals
+// that the USB IN path cannot keep up with the stack.
+func (iface *Interface) LinkDrops() uint64 {
+	stats := iface.QueueStats()
+	return stats.DroppedNewest + stats.DroppedOldest
+}
+
+// QueueDepth returns the number of outbound packets currently queued for
+// transmission, out of QueueSize.
+func (iface *Interface) QueueDepth() int {
+	if iface.Link == nil {
+		return 0
+	}
+
+	return iface.Link.NumQueued()
+}
@@ -0,0 +1,439 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// mDNS parameters (RFC 6762)
+const (
+	mdnsPort = 5353
+
+	// p42, 10. Resource Record TTL Values and Cache Coherency, RFC 6762
+	mdnsHostTTL  = 120
+	mdnsOtherTTL = 4500
+
+	// p51, 11. Source Address Check, RFC 6762
+	mdnsIPTTL = 255
+
+	// p40, 10.2. Announcements to Flush Outdated Cache Entries, RFC 6762
+	mdnsCacheFlush = 0x8000
+	// p20, 5.4. Questions Requesting Unicast Responses, RFC 6762
+	mdnsUnicastResponse = 0x8000
+
+	mdnsMaxPointers = 16
+)
+
+// DNS resource record types and class (RFC 1035, RFC 2782)
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN = 1
+)
+
+// MDNSGroup represents the mDNS IPv4 multicast group
+var MDNSGroup = net.IPv4(224, 0, 0, 251)
+
+// ServiceRecord represents a DNS Service Discovery (RFC 6763) service
+// advertised by ServeMDNS().
+type ServiceRecord struct {
+	// Instance is the service instance name, the hostname is used if
+	// empty.
+	Instance string
+
+	// Service is the service type and protocol (e.g. "_http._tcp").
+	Service string
+
+	// Port is the service port.
+	Port uint16
+
+	// Text represents the service TXT record strings (e.g. "path=/").
+	Text []string
+}
+
+type mdnsQuestion struct {
+	name    string
+	qtype   uint16
+	unicast bool
+}
+
+type mdnsRecord struct {
+	name  string
+	rtype uint16
+	flush bool
+	ttl   uint32
+	data  []byte
+}
+
+// mdnsName reads a (possibly compressed) domain name at the argument offset,
+// returning the offset following it.
+func mdnsName(msg []byte, off int) (name string, next int, err error) {
+	var labels []string
+
+	next = -1
+
+	for ptrs := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("invalid name")
+		}
+
+		n := int(msg[off])
+
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) || ptrs >= mdnsMaxPointers {
+				return "", 0, errors.New("invalid name pointer")
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			ptrs++
+		case n&0xc0 == 0:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("invalid label")
+			}
+
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		default:
+			return "", 0, errors.New("invalid label type")
+		}
+	}
+}
+
+// parseMDNSQuery parses an mDNS query message, returning its identifier and
+// questions.
+func parseMDNSQuery(msg []byte) (id uint16, questions []mdnsQuestion, err error) {
+	if len(msg) < 12 {
+		return 0, nil, errors.New("invalid message length")
+	}
+
+	id = binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+
+	// ignore responses and non-standard queries
+	if flags&0x8000 != 0 || (flags>>11)&0xf != 0 {
+		return 0, nil, errors.New("not a standard query")
+	}
+
+	off := 12
+
+	for i := 0; i < qdcount; i++ {
+		var q mdnsQuestion
+
+		if q.name, off, err = mdnsName(msg, off); err != nil {
+			return
+		}
+
+		if off+4 > len(msg) {
+			return 0, nil, errors.New("invalid question")
+		}
+
+		q.qtype = binary.BigEndian.Uint16(msg[off:])
+		qclass := binary.BigEndian.Uint16(msg[off+2:])
+		q.unicast = qclass&mdnsUnicastResponse != 0
+		off += 4
+
+		if qclass&^mdnsUnicastResponse == dnsClassIN || qclass&^mdnsUnicastResponse == dnsTypeANY {
+			questions = append(questions, q)
+		}
+	}
+
+	return
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+
+	return append(b, 0)
+}
+
+func (r *mdnsRecord) bytes(legacy bool) (b []byte) {
+	class := uint16(dnsClassIN)
+	ttl := r.ttl
+
+	if legacy {
+		// p15, 6.7. Legacy Unicast Responses, RFC 6762
+		ttl = min(ttl, 10)
+	} else if r.flush {
+		class |= mdnsCacheFlush
+	}
+
+	b = appendName(b, r.name)
+	b = binary.BigEndian.AppendUint16(b, r.rtype)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.data)))
+
+	return append(b, r.data...)
+}
+
+// mdnsRecords returns all resource records advertised for the argument
+// hostname, address and services.
+func mdnsRecords(host string, addr net.IP, services []ServiceRecord) (records []mdnsRecord) {
+	host = host + ".local"
+
+	records = append(records, mdnsRecord{
+		name:  host,
+		rtype: dnsTypeA,
+		flush: true,
+		ttl:   mdnsHostTTL,
+		data:  addr.To4(),
+	})
+
+	for _, s := range services {
+		instance := s.Instance
+
+		if instance == "" {
+			instance = strings.TrimSuffix(host, ".local")
+		}
+
+		service := s.Service + ".local"
+		instance = instance + "." + service
+
+		records = append(records, mdnsRecord{
+			name:  "_services._dns-sd._udp.local",
+			rtype: dnsTypePTR,
+			ttl:   mdnsOtherTTL,
+			data:  appendName(nil, service),
+		})
+
+		records = append(records, mdnsRecord{
+			name:  service,
+			rtype: dnsTypePTR,
+			ttl:   mdnsOtherTTL,
+			data:  appendName(nil, instance),
+		})
+
+		srv := make([]byte, 6)
+		binary.BigEndian.PutUint16(srv[4:], s.Port)
+
+		records = append(records, mdnsRecord{
+			name:  instance,
+			rtype: dnsTypeSRV,
+			flush: true,
+			ttl:   mdnsHostTTL,
+			data:  appendName(srv, host),
+		})
+
+		var txt []byte
+
+		for _, t := range s.Text {
+			txt = append(txt, byte(len(t)))
+			txt = append(txt, t...)
+		}
+
+		// p12, 6.1. General Format Rules for DNS TXT Records, RFC 6763
+		if len(txt) == 0 {
+			txt = []byte{0}
+		}
+
+		records = append(records, mdnsRecord{
+			name:  instance,
+			rtype: dnsTypeTXT,
+			flush: true,
+			ttl:   mdnsOtherTTL,
+			data:  txt,
+		})
+	}
+
+	return
+}
+
+// mdnsResponse builds an mDNS response message carrying the argument
+// records, legacy unicast responses echo the query identifier and question.
+func mdnsResponse(id uint16, question []byte, records []mdnsRecord, legacy bool) (b []byte) {
+	qdcount := 0
+
+	if legacy && len(question) > 0 {
+		qdcount = 1
+	}
+
+	b = binary.BigEndian.AppendUint16(b, id)
+	// QR, AA
+	b = binary.BigEndian.AppendUint16(b, 0x8400)
+	b = binary.BigEndian.AppendUint16(b, uint16(qdcount))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(records)))
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+
+	if qdcount > 0 {
+		b = append(b, question...)
+	}
+
+	for _, r := range records {
+		b = append(b, r.bytes(legacy)...)
+	}
+
+	return
+}
+
+// JoinGroup joins the interface to the argument IPv4 multicast group.
+func (iface *Interface) JoinGroup(group net.IP) error {
+	if err := iface.Stack.JoinGroup(ipv4.ProtocolNumber, iface.NICID, tcpip.AddrFromSlice(group.To4())); err != nil {
+		return fmt.Errorf("%v", err)
+	}
+
+	return nil
+}
+
+// LeaveGroup removes the interface from the argument IPv4 multicast group.
+func (iface *Interface) LeaveGroup(group net.IP) error {
+	if err := iface.Stack.LeaveGroup(ipv4.ProtocolNumber, iface.NICID, tcpip.AddrFromSlice(group.To4())); err != nil {
+		return fmt.Errorf("%v", err)
+	}
+
+	return nil
+}
+
+// ServeMDNS runs a Multicast DNS (RFC 6762) responder, until ctx is
+// cancelled, answering A queries for the interface hostname (see Hostname())
+// within the ".local" domain as well as DNS Service Discovery (RFC 6763)
+// PTR, SRV and TXT queries for the argument services.
+//
+// All records are announced once on startup, unique records (A, SRV, TXT)
+// carry the cache-flush bit.
+func (iface *Interface) ServeMDNS(ctx context.Context, services []ServiceRecord) (err error) {
+	var wq waiter.Queue
+
+	for _, s := range services {
+		if s.Service == "" || s.Port == 0 {
+			return fmt.Errorf("invalid service %q", s.Service)
+		}
+	}
+
+	if err = iface.JoinGroup(MDNSGroup); err != nil {
+		return
+	}
+	defer iface.LeaveGroup(MDNSGroup)
+
+	ep, tcpipErr := iface.Stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if tcpipErr != nil {
+		return fmt.Errorf("endpoint error (mdns): %v", tcpipErr)
+	}
+
+	ep.SetSockOptInt(tcpip.MulticastTTLOption, mdnsIPTTL)
+	ep.SetSockOptInt(tcpip.IPv4TTLOption, mdnsIPTTL)
+
+	if tcpipErr = ep.Bind(tcpip.FullAddress{Port: mdnsPort, NIC: iface.NICID}); tcpipErr != nil {
+		ep.Close()
+		return fmt.Errorf("bind error (mdns endpoint): %v", tcpipErr)
+	}
+
+	conn := gonet.NewUDPConn(&wq, ep)
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	mcast := &net.UDPAddr{IP: MDNSGroup, Port: mdnsPort}
+	records := mdnsRecords(iface.Hostname(), net.IP(iface.addr.AsSlice()), services)
+
+	// p31, 8.3. Announcing, RFC 6762
+	conn.WriteTo(mdnsResponse(0, nil, records, false), mcast)
+
+	buf := make([]byte, MTU)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		id, questions, err := parseMDNSQuery(buf[:n])
+
+		if err != nil || len(questions) == 0 {
+			continue
+		}
+
+		src, ok := addr.(*net.UDPAddr)
+
+		if !ok {
+			continue
+		}
+
+		// p15, 6.7. Legacy Unicast Responses, RFC 6762
+		legacy := src.Port != mdnsPort
+		unicast := legacy
+
+		var answers []mdnsRecord
+
+		// refresh records as the hostname might have changed
+		records = mdnsRecords(iface.Hostname(), net.IP(iface.addr.AsSlice()), services)
+
+		for _, q := range questions {
+			unicast = unicast || q.unicast
+
+			for _, r := range records {
+				if strings.EqualFold(r.name, q.name) && (q.qtype == r.rtype || q.qtype == dnsTypeANY) {
+					answers = append(answers, r)
+				}
+			}
+		}
+
+		if len(answers) == 0 {
+			continue
+		}
+
+		var question []byte
+
+		if legacy {
+			// echo the first question
+			_, end, _ := mdnsName(buf[:n], 12)
+			question = append(question, buf[12:end+4]...)
+		} else {
+			id = 0
+		}
+
+		dst := mcast
+
+		if unicast {
+			dst = src
+		}
+
+		conn.WriteTo(mdnsResponse(id, question, answers, legacy), dst)
+	}
+}
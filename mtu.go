@@ -0,0 +1,249 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// writeIPv4 queues an IPv4 packet, bypassing the stack network layer, for
+// transmission on the link.
+func (iface *Interface) writeIPv4(b []byte) error {
+	var pkts stack.PacketBufferList
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(b),
+	})
+	defer pkt.DecRef()
+
+	pkt.NetworkProtocolNumber = ipv4.ProtocolNumber
+	pkts.PushBack(pkt)
+
+	if n, err := iface.Link.WritePackets(pkts); err != nil {
+		return fmt.Errorf("%v", err)
+	} else if n != 1 {
+		return errors.New("link queue full")
+	}
+
+	return nil
+}
+
+// defaultTTL returns the stack default IPv4 TTL (see SetDefaultHopLimit()).
+func (iface *Interface) defaultTTL() uint8 {
+	var ttl tcpip.DefaultTTLOption
+
+	if err := iface.Stack.NetworkProtocolOption(ipv4.ProtocolNumber, &ttl); err != nil {
+		return ipv4.DefaultTTL
+	}
+
+	return uint8(ttl)
+}
+
+// mtuProbe represents an outstanding VerifyMTUHost() echo request, matched
+// against ICMP fragmentation needed errors received in response.
+type mtuProbe struct {
+	dst   tcpip.Address
+	ident uint16
+	mtu   chan uint16
+}
+
+// match reports the next-hop MTU of the argument Ethernet frame if it carries
+// an ICMP fragmentation needed error for the probe echo request.
+func (p *mtuProbe) match(frame []byte) {
+	if binary.BigEndian.Uint16(frame[12:14]) != uint16(header.IPv4ProtocolNumber) {
+		return
+	}
+
+	ip := header.IPv4(frame[14:])
+
+	if !ip.IsValid(len(ip)) || ip.Protocol() != uint8(header.ICMPv4ProtocolNumber) {
+		return
+	}
+
+	icmp := header.ICMPv4(ip.Payload())
+
+	if len(icmp) < header.ICMPv4MinimumSize ||
+		icmp.Type() != header.ICMPv4DstUnreachable ||
+		icmp.Code() != header.ICMPv4FragmentationNeeded {
+		return
+	}
+
+	// the error carries the original IP header and at least 8 bytes of
+	// its payload
+	orig := header.IPv4(icmp.Payload())
+
+	if len(orig) < header.IPv4MinimumSize {
+		return
+	}
+
+	hdrLen := int(orig.HeaderLength())
+
+	if hdrLen < header.IPv4MinimumSize || len(orig) < hdrLen+header.ICMPv4MinimumSize {
+		return
+	}
+
+	if orig.Protocol() != uint8(header.ICMPv4ProtocolNumber) || orig.DestinationAddress() != p.dst {
+		return
+	}
+
+	if header.ICMPv4(orig[hdrLen:]).Ident() != p.ident {
+		return
+	}
+
+	select {
+	case p.mtu <- icmp.MTU():
+	default:
+	}
+}
+
+// VerifyMTU verifies that the host accepts frames of the interface MTU (see
+// VerifyMTUHost()), using the host IPv4 address learned by the NIC (see
+// NIC.Host()).
+func (iface *Interface) VerifyMTU(ctx context.Context) error {
+	if iface.NIC == nil {
+		return errors.New("interface not initialized")
+	}
+
+	hostIP, _ := iface.NIC.Host()
+
+	if hostIP == nil {
+		return errors.New("host address not yet learned")
+	}
+
+	return iface.VerifyMTUHost(ctx, hostIP.String())
+}
+
+// VerifyMTUHost verifies that the argument host accepts frames of the
+// interface MTU by sending it an ICMP echo request, with the Don't Fragment
+// flag set, sized to fill the MTU and waiting for its full sized reply.
+//
+// An error is returned if an ICMP fragmentation needed error is received in
+// response, or if the reply is not received before ctx expires (or is
+// cancelled), therefore ctx should carry a timeout. The function is meant to
+// be optionally invoked once the link is up, to detect MTU mismatches between
+// device and host.
+func (iface *Interface) VerifyMTUHost(ctx context.Context, host string) (err error) {
+	var wq waiter.Queue
+
+	if iface.NIC == nil {
+		return errors.New("interface not initialized")
+	}
+
+	dst := net.ParseIP(host).To4()
+
+	if dst == nil {
+		return fmt.Errorf("invalid IPv4 address %q", host)
+	}
+
+	ep, tcpipErr := iface.Stack.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
+
+	if tcpipErr != nil {
+		return fmt.Errorf("endpoint error (icmp): %v", tcpipErr)
+	}
+	defer ep.Close()
+
+	if tcpipErr = ep.Bind(tcpip.FullAddress{Addr: iface.addr, NIC: iface.NICID}); tcpipErr != nil {
+		return fmt.Errorf("bind error (icmp endpoint): %v", tcpipErr)
+	}
+
+	local, tcpipErr := ep.GetLocalAddress()
+
+	if tcpipErr != nil {
+		return fmt.Errorf("%v", tcpipErr)
+	}
+
+	mtu := int(iface.Link.MTU())
+	pkt := make([]byte, mtu)
+
+	ip := header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(mtu),
+		TTL:         iface.defaultTTL(),
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		Flags:       header.IPv4FlagDontFragment,
+		SrcAddr:     iface.addr,
+		DstAddr:     tcpip.AddrFromSlice(dst),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	echo := header.ICMPv4(pkt[header.IPv4MinimumSize:])
+	echo.SetType(header.ICMPv4Echo)
+	echo.SetIdent(local.Port)
+	echo.SetSequence(1)
+
+	payload := echo.Payload()
+
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	echo.SetChecksum(^checksum.Checksum(echo, 0))
+
+	probe := &mtuProbe{
+		dst:   tcpip.AddrFromSlice(dst),
+		ident: local.Port,
+		mtu:   make(chan uint16, 1),
+	}
+
+	if !iface.NIC.mtuProbe.CompareAndSwap(nil, probe) {
+		return errors.New("MTU verification already in progress")
+	}
+	defer iface.NIC.mtuProbe.Store(nil)
+
+	entry, notify := waiter.NewChannelEntry(waiter.ReadableEvents)
+	wq.EventRegister(&entry)
+	defer wq.EventUnregister(&entry)
+
+	if err = iface.writeIPv4(pkt); err != nil {
+		return
+	}
+
+	for {
+		var buf bytes.Buffer
+
+		_, tcpipErr := ep.Read(&buf, tcpip.ReadOptions{})
+
+		switch tcpipErr.(type) {
+		case nil:
+			reply := header.ICMPv4(buf.Bytes())
+
+			if len(reply) >= header.ICMPv4MinimumSize && reply.Type() == header.ICMPv4EchoReply {
+				if !bytes.Equal(reply.Payload(), payload) {
+					return fmt.Errorf("MTU %d not verified, invalid reply (%d bytes)", mtu, len(reply)+header.IPv4MinimumSize)
+				}
+
+				return nil
+			}
+		case *tcpip.ErrWouldBlock:
+			select {
+			case <-notify:
+			case next := <-probe.mtu:
+				return fmt.Errorf("MTU %d not verified, fragmentation needed (next-hop MTU %d)", mtu, next)
+			case <-ctx.Done():
+				return fmt.Errorf("MTU %d not verified, %w", mtu, ctx.Err())
+			}
+		default:
+			return fmt.Errorf("MTU %d not verified, %v", mtu, tcpipErr)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// respondIPv4 simulates the host answering the first IPv4 packet transmitted
+// by the interface with the IPv4 packet returned by the argument function.
+func respondIPv4(ctx context.Context, iface *Interface, reply func(req header.IPv4) header.IPv4) {
+	go func() {
+		for {
+			pkt := iface.Link.ReadContext(ctx)
+
+			if pkt == nil {
+				return
+			}
+
+			frame := iface.NIC.frame(pkt)
+			proto := pkt.NetworkProtocolNumber
+			pkt.DecRef()
+
+			if proto != ipv4.ProtocolNumber {
+				continue
+			}
+
+			ip := reply(header.IPv4(frame[header.EthernetMinimumSize:]))
+			ip.SetChecksum(0)
+			ip.SetChecksum(^ip.CalculateChecksum())
+
+			icmp := header.ICMPv4(ip.Payload())
+			icmp.SetChecksum(0)
+			icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+
+			// swap Ethernet addresses
+			copy(frame[0:6], iface.NIC.DeviceMAC)
+			copy(frame[6:12], iface.NIC.HostMAC)
+			frame = append(frame[:header.EthernetMinimumSize], ip...)
+
+			iface.NIC.ReplayFrames([][]byte{frame}, 0)
+
+			return
+		}
+	}()
+}
+
+func TestVerifyMTU(t *testing.T) {
+	iface := newTestInterface(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := iface.VerifyMTU(ctx); err == nil {
+		t.Fatal("MTU verified without a learned host")
+	}
+
+	if err := iface.NIC.ReplayFrames([][]byte{arpRequest(iface)}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	respondIPv4(ctx, iface, func(req header.IPv4) header.IPv4 {
+		if req.TTL() != ipv4.DefaultTTL || req.Flags()&header.IPv4FlagDontFragment == 0 {
+			t.Errorf("unexpected echo request TTL %d, flags %#x", req.TTL(), req.Flags())
+		}
+
+		src, dst := req.SourceAddress(), req.DestinationAddress()
+		req.SetSourceAddress(dst)
+		req.SetDestinationAddress(src)
+		header.ICMPv4(req.Payload()).SetType(header.ICMPv4EchoReply)
+
+		return req
+	})
+
+	if err := iface.VerifyMTU(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyMTUFragmentationNeeded(t *testing.T) {
+	iface := newTestInterface(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := iface.SetDefaultHopLimit(16); err != nil {
+		t.Fatal(err)
+	}
+
+	respondIPv4(ctx, iface, func(req header.IPv4) header.IPv4 {
+		if req.TTL() != 16 {
+			t.Errorf("echo request TTL %d, want 16", req.TTL())
+		}
+
+		orig := req[:header.IPv4MinimumSize+header.ICMPv4MinimumSize]
+		ip := make(header.IPv4, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(orig))
+
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(ip)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     req.DestinationAddress(),
+			DstAddr:     req.SourceAddress(),
+		})
+
+		icmp := header.ICMPv4(ip.Payload())
+		icmp.SetType(header.ICMPv4DstUnreachable)
+		icmp.SetCode(header.ICMPv4FragmentationNeeded)
+		icmp.SetMTU(1400)
+		copy(icmp.Payload(), orig)
+
+		return ip
+	})
+
+	err := iface.VerifyMTUHost(ctx, testHostIP)
+
+	if err == nil || !strings.Contains(err.Error(), "next-hop MTU 1400") {
+		t.Fatalf("VerifyMTUHost() error = %v, want fragmentation needed", err)
+	}
+}
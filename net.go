@@ -21,9 +21,11 @@ package usbnet
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 
 	"github.com/usbarmory/tamago/soc/nxp/usb"
 
@@ -33,6 +35,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
@@ -47,7 +50,16 @@ var (
 	// NICID represents the default gVisor NIC identifier
 	NICID = tcpip.NICID(1)
 
-	// DefaultStackOptions represents the default gVisor Stack configuration
+	// QueueSize represents the gVisor link endpoint outbound queue size
+	QueueSize = 256
+
+	// DefaultStackOptions represents the default gVisor Stack
+	// configuration, used for interfaces without a previously assigned
+	// Stack. As each Stack instantiates its own protocols its later
+	// modification only affects interfaces initialized afterwards.
+	//
+	// The options are shallow copied, pointer fields (e.g. Clock, Stats,
+	// RandSource) if set are shared by all stacks created from them.
 	DefaultStackOptions = stack.Options{
 		NetworkProtocols: []stack.NetworkProtocolFactory{
 			ipv4.NewProtocol,
@@ -59,6 +71,20 @@ var (
 	}
 )
 
+// ErrLinkDown is returned by dial functions when the host has not activated
+// the data interface (see NIC.LinkUp()), callers can wait for the link to be
+// up (see LinkEvents()) before retrying.
+//
+// It is only returned while the link state is tracked (see
+// NIC.LinkTracked()), otherwise dials are attempted regardless. After the
+// device is unplugged the link is still reported up, and dials attempted,
+// until the next host SET_CONFIGURATION request.
+var ErrLinkDown = errors.New("link down")
+
+// ErrNoIPv4 is returned by IPv4 specific functions on interfaces configured
+// with an IPv6 address (see Interface.DisableIPv4).
+var ErrNoIPv4 = errors.New("interface has no IPv4 address")
+
 // Interface represents an Ethernet over USB interface instance.
 type Interface struct {
 	NICID tcpip.NICID
@@ -67,12 +93,89 @@ type Interface struct {
 	Stack *stack.Stack
 	Link  *channel.Endpoint
 
-	addr tcpip.Address
+	// Profile is the USB descriptor profile (see ConfigureDeviceProfile()),
+	// DefaultProfile is used if not previously assigned.
+	Profile *Profile
+
+	// DisableIPv4 and EnableIPv6 restrict or extend the address families
+	// configured on the interface, and on its stack if not previously
+	// assigned, which by default only supports IPv4 (see stackOptions()).
+	// At least one family must be enabled.
+	//
+	// Interfaces with an IPv6 address are served with the family agnostic
+	// ListenerTCP(), ListenerUDP(), DialContext() and EnableICMP()
+	// functions, IPv4 listeners return ErrNoIPv4 while the remaining IPv4
+	// functions (e.g. DialTCP4(), VerifyMTU()) fail. The SecurityPolicy
+	// SourceSubnet restriction and host address learning (see NIC.Host())
+	// only apply to IPv4.
+	DisableIPv4 bool
+	EnableIPv6  bool
+
+	// ConfigurationIndex is the USB device configuration populated by
+	// Add() (see ConfigureDeviceProfiles()), the first one by default.
+	ConfigurationIndex int
+
+	// LookupHost is an optional function to resolve names to IP
+	// addresses for DialContext().
+	LookupHost func(ctx context.Context, host string) (addrs []string, err error)
+
+	addr   tcpip.Address
+	linkEP *linkEndpoint
+
+	mu             sync.Mutex
+	hostname       string
+	dialPreference DialPreference
+}
+
+// stackOptions returns the gVisor Stack configuration for the interface
+// address families, DefaultStackOptions is used as is for IPv4 only
+// interfaces while its protocols are replaced for any other combination.
+//
+// A single interface should be used to run both families over the same USB
+// link, as its endpoints cannot be shared by two NICs. Separate IPv4 and IPv6
+// stacks are therefore only possible on distinct USB functions or devices.
+func (iface *Interface) stackOptions() (opts stack.Options) {
+	opts = DefaultStackOptions
+
+	if !iface.DisableIPv4 && !iface.EnableIPv6 {
+		return
+	}
+
+	opts.NetworkProtocols = nil
+	opts.TransportProtocols = []stack.TransportProtocolFactory{
+		tcp.NewProtocol,
+		udp.NewProtocol,
+	}
+
+	if !iface.DisableIPv4 {
+		opts.NetworkProtocols = append(opts.NetworkProtocols, ipv4.NewProtocol, arp.NewProtocol)
+		opts.TransportProtocols = append(opts.TransportProtocols, icmp.NewProtocol4)
+	}
+
+	if iface.EnableIPv6 {
+		opts.NetworkProtocols = append(opts.NetworkProtocols, ipv6.NewProtocol)
+		opts.TransportProtocols = append(opts.TransportProtocols, icmp.NewProtocol6)
+	}
+
+	return
 }
 
 func (iface *Interface) configure(mac string) (err error) {
+	var protocolAddrs []tcpip.ProtocolAddress
+	var routes []tcpip.Route
+
+	if iface.DisableIPv4 && !iface.EnableIPv6 {
+		return errors.New("no address family enabled")
+	}
+
+	v4 := iface.addr.Len() == net.IPv4len
+
+	if (v4 && iface.DisableIPv4) || (!v4 && !iface.EnableIPv6) {
+		return errors.New("address family not enabled")
+	}
+
 	if iface.Stack == nil {
-		iface.Stack = stack.New(DefaultStackOptions)
+		iface.Stack = stack.New(iface.stackOptions())
 	}
 
 	linkAddr, err := tcpip.ParseMACAddress(mac)
@@ -81,41 +184,79 @@ func (iface *Interface) configure(mac string) (err error) {
 		return
 	}
 
-	iface.Link = channel.New(256, MTU, linkAddr)
+	iface.Link = channel.New(QueueSize, MTU, linkAddr)
+	iface.linkEP = newLinkEndpoint(iface.Link)
 
-	linkEP := stack.LinkEndpoint(iface.Link)
+	linkEP := stack.LinkEndpoint(iface.linkEP)
 
 	if err := iface.Stack.CreateNIC(iface.NICID, linkEP); err != nil {
 		return fmt.Errorf("%v", err)
 	}
 
-	protocolAddr := tcpip.ProtocolAddress{
-		Protocol:          ipv4.ProtocolNumber,
-		AddressWithPrefix: iface.addr.WithPrefix(),
-	}
+	if v4 {
+		protocolAddrs = append(protocolAddrs, tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: iface.addr.WithPrefix(),
+		})
 
-	if err := iface.Stack.AddProtocolAddress(iface.NICID, protocolAddr, stack.AddressProperties{}); err != nil {
-		return fmt.Errorf("%v", err)
+		routes = append(routes, tcpip.Route{
+			Destination: header.IPv4EmptySubnet,
+			NIC:         iface.NICID,
+		})
 	}
 
-	rt := iface.Stack.GetRouteTable()
+	if iface.EnableIPv6 {
+		protocolAddrs = append(protocolAddrs, tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: header.LinkLocalAddr(linkAddr).WithPrefix(),
+		})
+
+		if !v4 {
+			protocolAddrs = append(protocolAddrs, tcpip.ProtocolAddress{
+				Protocol:          ipv6.ProtocolNumber,
+				AddressWithPrefix: iface.addr.WithPrefix(),
+			})
+		}
 
-	rt = append(rt, tcpip.Route{
-		Destination: header.IPv4EmptySubnet,
-		NIC:         iface.NICID,
-	})
+		routes = append(routes, tcpip.Route{
+			Destination: header.IPv6EmptySubnet,
+			NIC:         iface.NICID,
+		})
+	}
+
+	for _, protocolAddr := range protocolAddrs {
+		if err := iface.Stack.AddProtocolAddress(iface.NICID, protocolAddr, stack.AddressProperties{}); err != nil {
+			return fmt.Errorf("%v", err)
+		}
+	}
 
-	iface.Stack.SetRouteTable(rt)
+	iface.Stack.SetRouteTable(append(iface.Stack.GetRouteTable(), routes...))
 
 	return
 }
 
-// EnableICMP adds an ICMP endpoint to the interface, it is useful to enable
-// ping requests.
+// protocol returns the network protocol of the interface address.
+func (iface *Interface) protocol() tcpip.NetworkProtocolNumber {
+	if iface.addr.Len() == net.IPv6len {
+		return ipv6.ProtocolNumber
+	}
+
+	return ipv4.ProtocolNumber
+}
+
+// EnableICMP adds an ICMP endpoint to the interface, for the address family
+// of its address, it is useful to enable ping requests.
 func (iface *Interface) EnableICMP() error {
 	var wq waiter.Queue
 
-	ep, err := iface.Stack.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
+	proto := iface.protocol()
+	transport := icmp.ProtocolNumber4
+
+	if proto == ipv6.ProtocolNumber {
+		transport = icmp.ProtocolNumber6
+	}
+
+	ep, err := iface.Stack.NewEndpoint(transport, proto, &wq)
 
 	if err != nil {
 		return fmt.Errorf("endpoint error (icmp): %v", err)
@@ -124,17 +265,54 @@ func (iface *Interface) EnableICMP() error {
 	fullAddr := tcpip.FullAddress{Addr: iface.addr, Port: 0, NIC: iface.NICID}
 
 	if err := ep.Bind(fullAddr); err != nil {
-		return fmt.Errorf("bind error (icmp endpoint): ", err)
+		return fmt.Errorf("bind error (icmp endpoint): %v", err)
 	}
 
 	return nil
 }
 
-// ListenerTCP4 returns a net.Listener capable of accepting IPv4 TCP
-// connections for the argument port.
-func (iface *Interface) ListenerTCP4(port uint16) (net.Listener, error) {
+// SetDefaultHopLimit sets the default IPv4 TTL and IPv6 hop limit used by the
+// stack for outgoing packets, the gVisor default (64) applies if never
+// invoked.
+func (iface *Interface) SetDefaultHopLimit(limit uint8) error {
+	if limit == 0 {
+		return errors.New("invalid hop limit")
+	}
+
+	opt := tcpip.DefaultTTLOption(limit)
+	set := false
+
+	// each protocol is only registered when its address family is enabled
+	for _, proto := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+		err := iface.Stack.SetNetworkProtocolOption(proto, &opt)
+
+		switch err.(type) {
+		case nil:
+			set = true
+		case *tcpip.ErrUnknownProtocol:
+		default:
+			return fmt.Errorf("%v", err)
+		}
+	}
+
+	if !set {
+		return errors.New("no network protocol available")
+	}
+
+	return nil
+}
+
+// linkDown returns whether the interface NIC link is known to be down, which
+// is never the case when its state is not tracked (see NIC.LinkTracked()).
+func (iface *Interface) linkDown() bool {
+	return iface.NIC != nil && iface.NIC.LinkTracked() && !iface.NIC.LinkUp()
+}
+
+// ListenerTCP returns a net.Listener capable of accepting TCP connections
+// for the argument port, on the address family of the interface address.
+func (iface *Interface) ListenerTCP(port uint16) (net.Listener, error) {
 	fullAddr := tcpip.FullAddress{Addr: iface.addr, Port: port, NIC: iface.NICID}
-	listener, err := gonet.ListenTCP(iface.Stack, fullAddr, ipv4.ProtocolNumber)
+	listener, err := gonet.ListenTCP(iface.Stack, fullAddr, iface.protocol())
 
 	if err != nil {
 		return nil, err
@@ -143,14 +321,29 @@ func (iface *Interface) ListenerTCP4(port uint16) (net.Listener, error) {
 	return (net.Listener)(listener), nil
 }
 
+// ListenerTCP4 returns a net.Listener capable of accepting IPv4 TCP
+// connections for the argument port.
+func (iface *Interface) ListenerTCP4(port uint16) (net.Listener, error) {
+	if iface.protocol() != ipv4.ProtocolNumber {
+		return nil, ErrNoIPv4
+	}
+
+	return iface.ListenerTCP(port)
+}
+
 // DialTCP4 connects to an IPv4 TCP address.
 func (iface *Interface) DialTCP4(address string) (net.Conn, error) {
 	return iface.DialContextTCP4(context.Background(), address)
 }
 
 // DialContextTCP4 connects to an IPv4 TCP address with support for timeout
-// supplied by ctx.
+// supplied by ctx, ErrLinkDown is returned if the host has not activated the
+// data interface.
 func (iface *Interface) DialContextTCP4(ctx context.Context, address string) (net.Conn, error) {
+	if iface.linkDown() {
+		return nil, ErrLinkDown
+	}
+
 	fullAddr, err := fullAddr(address)
 
 	if err != nil {
@@ -167,12 +360,17 @@ func (iface *Interface) DialContextTCP4(ctx context.Context, address string) (ne
 }
 
 // DialUDP4 creates a UDP connection to the ip:port specified by rAddr, optionally setting
-// the local ip:port to lAddr.
+// the local ip:port to lAddr. When rAddr is set ErrLinkDown is returned if the
+// host has not activated the data interface.
 func (iface *Interface) DialUDP4(lAddr, rAddr string) (net.Conn, error) {
 	var lFullAddr tcpip.FullAddress
 	var rFullAddr tcpip.FullAddress
 	var err error
 
+	if rAddr != "" && iface.linkDown() {
+		return nil, ErrLinkDown
+	}
+
 	if lAddr != "" {
 		if lFullAddr, err = fullAddr(lAddr); err != nil {
 			return nil, fmt.Errorf("failed to parse lAddr %q: %v", lAddr, err)
@@ -194,6 +392,100 @@ func (iface *Interface) DialUDP4(lAddr, rAddr string) (net.Conn, error) {
 	return (net.Conn)(conn), nil
 }
 
+// ResetConnection aborts the TCP connection matching the argument local and
+// remote ip:port addresses, sending a reset (RST) to the peer and releasing
+// its resources.
+func (iface *Interface) ResetConnection(local, remote string) error {
+	lFullAddr, err := fullAddr(local)
+
+	if err != nil {
+		return fmt.Errorf("failed to parse local %q: %v", local, err)
+	}
+
+	rFullAddr, err := fullAddr(remote)
+
+	if err != nil {
+		return fmt.Errorf("failed to parse remote %q: %v", remote, err)
+	}
+
+	for _, ep := range iface.Stack.RegisteredEndpoints() {
+		tcpEP, ok := ep.(*tcp.Endpoint)
+
+		if !ok {
+			continue
+		}
+
+		info, ok := tcpEP.Info().(*stack.TransportEndpointInfo)
+
+		if !ok {
+			continue
+		}
+
+		id := info.ID
+
+		if id.LocalAddress == lFullAddr.Addr && id.LocalPort == lFullAddr.Port &&
+			id.RemoteAddress == rFullAddr.Addr && id.RemotePort == rFullAddr.Port {
+			tcpEP.Abort()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no connection found between %s and %s", local, remote)
+}
+
+// TCPStateCounts returns the number of TCP endpoints registered with the
+// stack in each state (e.g. "LISTEN", "ESTABLISHED", "TIME-WAIT"), states
+// without endpoints are omitted.
+//
+// A steadily growing "TIME-WAIT" count signals a risk of ephemeral port
+// exhaustion. Endpoints not yet bound are not registered, and therefore
+// not accounted for.
+func (iface *Interface) TCPStateCounts() map[string]int {
+	counts := make(map[string]int)
+
+	for _, ep := range iface.Stack.RegisteredEndpoints() {
+		if tcpEP, ok := ep.(*tcp.Endpoint); ok {
+			counts[tcp.EndpointState(tcpEP.State()).String()]++
+		}
+	}
+
+	return counts
+}
+
+// LinkEvents returns a channel delivering link state changes, see
+// NIC.LinkEvents(), a closed channel is returned if the interface is not yet
+// initialized.
+func (iface *Interface) LinkEvents() <-chan bool {
+	if iface.NIC == nil {
+		events := make(chan bool)
+		close(events)
+
+		return events
+	}
+
+	return iface.NIC.LinkEvents()
+}
+
+// Close removes the interface NIC from the stack, closing its link endpoint
+// and link events channel.
+func (iface *Interface) Close() (err error) {
+	if iface.NIC != nil {
+		iface.NIC.Close()
+	}
+
+	if iface.Stack != nil {
+		if err := iface.Stack.RemoveNIC(iface.NICID); err != nil {
+			return fmt.Errorf("%v", err)
+		}
+	}
+
+	if iface.Link != nil {
+		iface.Link.Close()
+	}
+
+	return
+}
+
 // fullAddr attempts to convert the ip:port to a FullAddress struct.
 func fullAddr(a string) (tcpip.FullAddress, error) {
 	var p int
@@ -209,7 +501,12 @@ func fullAddr(a string) (tcpip.FullAddress, error) {
 	}
 
 	addr := net.ParseIP(host)
-	return tcpip.FullAddress{Addr: tcpip.AddrFromSlice(addr.To4()), Port: uint16(p)}, nil
+
+	if addr4 := addr.To4(); addr4 != nil {
+		addr = addr4
+	}
+
+	return tcpip.FullAddress{Addr: tcpip.AddrFromSlice(addr), Port: uint16(p)}, nil
 }
 
 // Add adds an Ethernet over USB configuration to a previously configured USB
@@ -231,7 +528,17 @@ func (iface *Interface) Add(device *usb.Device, deviceIP string, deviceMAC strin
 		iface.NICID = NICID
 	}
 
-	iface.addr = tcpip.AddrFromSlice(net.ParseIP(deviceIP)).To4()
+	ip := net.ParseIP(deviceIP)
+
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q", deviceIP)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	iface.addr = tcpip.AddrFromSlice(ip)
 
 	if err = iface.configure(deviceMAC); err != nil {
 		return
@@ -243,6 +550,9 @@ func (iface *Interface) Add(device *usb.Device, deviceIP string, deviceMAC strin
 			DeviceMAC: deviceAddress,
 			Link:      iface.Link,
 			Device:    device,
+			Profile:   iface.Profile,
+
+			ConfigurationIndex: iface.ConfigurationIndex,
 		}
 
 		err = iface.NIC.Init()
@@ -255,8 +565,15 @@ func (iface *Interface) Add(device *usb.Device, deviceIP string, deviceMAC strin
 // its defaults) associating it to a gVisor link, a default NICID and TCP/IP
 // gVisor Stack are set if not previously assigned.
 func (iface *Interface) Init(deviceIP string, deviceMAC, hostMAC string) error {
+	if iface.Profile == nil {
+		iface.Profile = &DefaultProfile
+	}
+
 	device := &usb.Device{}
-	ConfigureDevice(device, deviceMAC)
+
+	if err := ConfigureDeviceProfile(device, deviceMAC, iface.Profile); err != nil {
+		return err
+	}
 
 	return iface.Add(device, deviceIP, deviceMAC, hostMAC)
 }
@@ -0,0 +1,165 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	testDeviceIP = "10.0.0.1"
+	testHostIP   = "10.0.0.2"
+)
+
+// newTestInterface returns an initialized interface, closed on test cleanup.
+func newTestInterface(t *testing.T) *Interface {
+	t.Helper()
+
+	iface := &Interface{}
+
+	if err := iface.Init(testDeviceIP, testDeviceMAC, testHostMAC); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { iface.Close() })
+
+	return iface
+}
+
+func TestDialLinkDown(t *testing.T) {
+	iface := newTestInterface(t)
+
+	if !iface.NIC.LinkTracked() {
+		t.Fatal("link not tracked after Init()")
+	}
+
+	if _, err := iface.DialTCP4(testHostIP + ":80"); !errors.Is(err, ErrLinkDown) {
+		t.Fatalf("DialTCP4() error = %v, want ErrLinkDown", err)
+	}
+
+	if _, err := iface.DialUDP4(testDeviceIP+":5353", testHostIP+":5353"); !errors.Is(err, ErrLinkDown) {
+		t.Fatalf("DialUDP4() error = %v, want ErrLinkDown", err)
+	}
+
+	conn, err := iface.DialUDP4(testDeviceIP+":5353", "")
+
+	if err != nil {
+		t.Fatalf("unconnected DialUDP4() error = %v", err)
+	}
+
+	conn.Close()
+
+	setConfiguration(iface.NIC, 1)
+	setInterface(iface.NIC, 0x01, usb.SET_INTERFACE, 1)
+
+	conn, err = iface.DialUDP4("", testHostIP+":5353")
+
+	if err != nil {
+		t.Fatalf("DialUDP4() error = %v with link up", err)
+	}
+
+	conn.Close()
+}
+
+func TestDialLinkUntracked(t *testing.T) {
+	iface := newTestInterface(t)
+
+	// composite device driver wrapping the setup function after Init()
+	setup := iface.NIC.Device.Setup
+
+	iface.NIC.Device.Setup = func(s *usb.SetupData) ([]byte, bool, bool, error) {
+		return setup(s)
+	}
+
+	if iface.NIC.LinkTracked() {
+		t.Fatal("link tracked after setup function replacement")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := iface.DialContextTCP4(ctx, testHostIP+":80"); errors.Is(err, ErrLinkDown) {
+		t.Fatal("DialContextTCP4() failed with ErrLinkDown on untracked link")
+	}
+}
+
+func TestSetDefaultHopLimitIPv6Only(t *testing.T) {
+	iface := &Interface{
+		DisableIPv4: true,
+		EnableIPv6:  true,
+	}
+
+	if err := iface.Init("fd00::1", testDeviceMAC, testHostMAC); err != nil {
+		t.Fatal(err)
+	}
+
+	defer iface.Close()
+
+	if err := iface.SetDefaultHopLimit(16); err != nil {
+		t.Fatal(err)
+	}
+
+	var opt tcpip.DefaultTTLOption
+
+	if err := iface.Stack.NetworkProtocolOption(ipv6.ProtocolNumber, &opt); err != nil || opt != 16 {
+		t.Fatalf("IPv6 hop limit = %d (%v), want 16", opt, err)
+	}
+}
+
+func TestLinkEvents(t *testing.T) {
+	if _, ok := <-(&Interface{}).LinkEvents(); ok {
+		t.Fatal("event received before Init()")
+	}
+
+	iface := newTestInterface(t)
+	events := iface.LinkEvents()
+
+	setConfiguration(iface.NIC, 1)
+	setInterface(iface.NIC, 0x01, usb.SET_INTERFACE, 1)
+
+	if up := <-events; !up {
+		t.Fatal("link down event after SET_INTERFACE")
+	}
+
+	iface.Close()
+
+	if _, ok := <-events; ok {
+		t.Fatal("events channel open after Close()")
+	}
+}
+
+func TestDefaultStackOptionsIndependence(t *testing.T) {
+	defaults := DefaultStackOptions
+	defer func() { DefaultStackOptions = defaults }()
+
+	before := newTestInterface(t)
+
+	DefaultStackOptions.TransportProtocols = []stack.TransportProtocolFactory{tcp.NewProtocol}
+
+	after := newTestInterface(t)
+
+	if before.Stack.TransportProtocolInstance(udp.ProtocolNumber) == nil {
+		t.Fatal("existing interface affected by DefaultStackOptions change")
+	}
+
+	if after.Stack.TransportProtocolInstance(udp.ProtocolNumber) != nil {
+		t.Fatal("new interface not reflecting DefaultStackOptions change")
+	}
+}
@@ -0,0 +1,186 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+)
+
+// pump transfers frames transmitted by the source NIC to the destination one,
+// through their endpoint functions, until ctx is done.
+func pump(ctx context.Context, src *NIC, dst *NIC) {
+	for ctx.Err() == nil {
+		frame, _ := src.Tx(nil, nil)
+
+		if frame == nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		dst.ReplayFrames([][]byte{frame}, 0)
+	}
+}
+
+// pairedInterfaces returns two interfaces, with active links, connected to
+// each other as device (a) and host (b).
+func pairedInterfaces(t *testing.T) (a *Interface, b *Interface) {
+	t.Helper()
+
+	a = &Interface{}
+	b = &Interface{}
+
+	if err := a.Init(testDeviceIP, testDeviceMAC, testHostMAC); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Init(testHostIP, testHostMAC, testDeviceMAC); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+
+	for _, link := range [][2]*NIC{{a.NIC, b.NIC}, {b.NIC, a.NIC}} {
+		setConfiguration(link[0], 1)
+		setInterface(link[0], 0x01, usb.SET_INTERFACE, 1)
+
+		go func() {
+			pump(ctx, link[0], link[1])
+			done <- struct{}{}
+		}()
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		<-done
+		a.Close()
+		b.Close()
+	})
+
+	return
+}
+
+func TestPairedTCP(t *testing.T) {
+	a, b := pairedInterfaces(t)
+
+	listener, err := b.ListenerTCP4(7)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := a.DialContextTCP4(ctx, testHostIP+":7")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// span several frames
+	msg := bytes.Repeat([]byte("usbnet"), 1024)
+	buf := make([]byte, len(msg))
+
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("echo mismatch")
+	}
+
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPairedUDP(t *testing.T) {
+	a, b := pairedInterfaces(t)
+
+	listener, err := b.ListenerUDP4(7)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := a.DialUDP4("", testHostIP+":7")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := []byte("usbnet")
+	buf := make([]byte, 64)
+
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := listener.ReadFrom(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf[:n], msg) || addr.(*net.UDPAddr).IP.String() != testDeviceIP {
+		t.Fatalf("received %q from %v", buf[:n], addr)
+	}
+
+	if _, err = listener.WriteTo(buf[:n], addr); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if n, err = conn.Read(buf); err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("reply %q, %v", buf[:n], err)
+	}
+}
+
+func TestPairedICMP(t *testing.T) {
+	a, _ := pairedInterfaces(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// full MTU echo request and reply
+	if err := a.VerifyMTUHost(ctx, testHostIP); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -45,6 +45,10 @@ func (iface *Interface) Socket(ctx context.Context, network string, family, soty
 		return nil, errors.New("unsupported address family")
 	}
 
+	if raddr != nil && iface.linkDown() {
+		return nil, ErrLinkDown
+	}
+
 	switch network {
 	case "udp", "udp4":
 		if sotype != syscall.SOCK_DGRAM {
@@ -0,0 +1,292 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ServiceSpec represents a service for Serve().
+type ServiceSpec struct {
+	// Network is the service protocol ("tcp" or "udp").
+	Network string
+
+	// Port is the service listening port.
+	Port uint16
+
+	// Handler is invoked, on its own goroutine, for each accepted TCP
+	// connection, which is closed on handler return or on shutdown.
+	Handler func(net.Conn)
+
+	// PacketHandler is invoked with the UDP listener, which is closed on
+	// shutdown to let the handler return.
+	PacketHandler func(net.PacketConn)
+}
+
+// ServeTCP accepts TCP connections on the argument port, on the address
+// family of the interface address, invoking the handler on its own goroutine
+// for each of them, until ctx is cancelled.
+//
+// On cancellation the listener and all accepted connections are closed, the
+// function returns the ctx error once all handlers have returned.
+func (iface *Interface) ServeTCP(ctx context.Context, port uint16, handler func(net.Conn)) error {
+	if handler == nil {
+		return errors.New("missing handler")
+	}
+
+	listener, err := iface.ListenerTCP(port)
+
+	if err != nil {
+		return err
+	}
+
+	return serveTCP(ctx, listener, handler)
+}
+
+// ServeTCP4 accepts IPv4 TCP connections on the argument port, invoking the
+// handler on its own goroutine for each of them, until ctx is cancelled (see
+// ServeTCP()).
+func (iface *Interface) ServeTCP4(ctx context.Context, port uint16, handler func(net.Conn)) error {
+	if handler == nil {
+		return errors.New("missing handler")
+	}
+
+	listener, err := iface.ListenerTCP4(port)
+
+	if err != nil {
+		return err
+	}
+
+	return serveTCP(ctx, listener, handler)
+}
+
+func serveTCP(ctx context.Context, listener net.Listener, handler func(net.Conn)) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	conns := make(map[net.Conn]bool)
+
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+	defer stop()
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			listener.Close()
+			wg.Wait()
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = true
+
+		// accepted after the shutdown closed tracked connections
+		if ctx.Err() != nil {
+			conn.Close()
+		}
+		mu.Unlock()
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			handler(conn)
+
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// ServeUDP listens for UDP datagrams on the argument port, on the address
+// family of the interface address, invoking the handler with the listener
+// until ctx is cancelled.
+//
+// On cancellation the listener is closed, the function returns the ctx error
+// once the handler has returned.
+func (iface *Interface) ServeUDP(ctx context.Context, port uint16, handler func(net.PacketConn)) error {
+	if handler == nil {
+		return errors.New("missing handler")
+	}
+
+	conn, err := iface.ListenerUDP(port)
+
+	if err != nil {
+		return err
+	}
+
+	return serveUDP(ctx, conn, handler)
+}
+
+// ServeUDP4 listens for IPv4 UDP datagrams on the argument port, invoking the
+// handler with the listener until ctx is cancelled (see ServeUDP()).
+func (iface *Interface) ServeUDP4(ctx context.Context, port uint16, handler func(net.PacketConn)) error {
+	if handler == nil {
+		return errors.New("missing handler")
+	}
+
+	conn, err := iface.ListenerUDP4(port)
+
+	if err != nil {
+		return err
+	}
+
+	return serveUDP(ctx, conn, handler)
+}
+
+func serveUDP(ctx context.Context, conn net.PacketConn, handler func(net.PacketConn)) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	handler(conn)
+	conn.Close()
+
+	return ctx.Err()
+}
+
+// Serve runs all argument services, on the address family of the interface
+// address, until ctx is cancelled or any of them fails, in which case all
+// others are shut down and the failing service error is returned.
+func (iface *Interface) Serve(ctx context.Context, services []ServiceSpec) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var serr error
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, s := range services {
+		if s.Network != "tcp" && s.Network != "udp" {
+			return fmt.Errorf("%s/%d: unsupported network", s.Network, s.Port)
+		}
+	}
+
+	for _, s := range services {
+		wg.Add(1)
+
+		go func() {
+			var err error
+
+			defer wg.Done()
+
+			switch s.Network {
+			case "tcp":
+				err = iface.ServeTCP(ctx, s.Port, s.Handler)
+			case "udp":
+				err = iface.ServeUDP(ctx, s.Port, s.PacketHandler)
+			}
+
+			if err != nil && ctx.Err() == nil {
+				once.Do(func() {
+					serr = fmt.Errorf("%s/%d: %w", s.Network, s.Port, err)
+				})
+
+				cancel()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if serr != nil {
+		return serr
+	}
+
+	return ctx.Err()
+}
+
+// closeWrite shuts down the writing side of a stream, if supported, or closes
+// it otherwise, in which case true is returned.
+func closeWrite(c io.Closer) (closed bool) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		return false
+	}
+
+	c.Close()
+
+	return true
+}
+
+// Splice copies data bidirectionally between a connection and a stream until
+// both directions are done, returning the number of bytes copied from a to b
+// and from b to a.
+//
+// The end of data on one side is propagated as a half-close (if supported,
+// or as a close otherwise) to the other side, while an error in either
+// direction closes both. Both a and b are always closed on return.
+func (iface *Interface) Splice(a net.Conn, b io.ReadWriteCloser) (aToB int64, bToA int64, err error) {
+	var once sync.Once
+	var closed atomic.Bool
+
+	fail := func(e error) {
+		if closed.Load() {
+			// errors caused by a close on half-close fallback
+			e = nil
+		}
+
+		once.Do(func() {
+			err = e
+			a.Close()
+			b.Close()
+		})
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		var cerr error
+
+		if aToB, cerr = io.Copy(b, a); cerr != nil {
+			fail(cerr)
+		} else if closeWrite(b) {
+			closed.Store(true)
+		}
+	}()
+
+	var cerr error
+
+	if bToA, cerr = io.Copy(a, b); cerr != nil {
+		fail(cerr)
+	} else if closeWrite(a) {
+		closed.Store(true)
+	}
+
+	<-done
+	fail(nil)
+
+	return
+}
@@ -0,0 +1,93 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TxShapingStats represents the transmit shaping counters.
+type TxShapingStats struct {
+	// DeferredFrames is the number of frames whose transmission was
+	// deferred, at least once, as over budget.
+	DeferredFrames uint64
+	// DeferredBytes is the size of deferred frames.
+	DeferredBytes uint64
+}
+
+// shaper implements a token bucket, refilled on each invocation according to
+// the time elapsed since the previous one as no timer is available on the
+// transmit path.
+type shaper struct {
+	sync.Mutex
+
+	rate   int64
+	tokens int64
+	last   time.Time
+
+	deferredFrames atomic.Uint64
+	deferredBytes  atomic.Uint64
+}
+
+// allow returns whether a frame of the argument size fits the budget,
+// consuming its tokens if so.
+func (s *shaper) allow(n int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rate == 0 {
+		return true
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(s.last)
+	s.last = now
+
+	// the bucket holds up to one second worth of tokens, and at least
+	// a full frame
+	burst := max(s.rate, int64(MTU)+14)
+	s.tokens = min(burst, s.tokens+elapsed.Nanoseconds()*s.rate/int64(time.Second))
+
+	if s.tokens < int64(n) {
+		return false
+	}
+
+	s.tokens -= int64(n)
+
+	return true
+}
+
+// SetTxRate limits the transmitted bandwidth to the argument bytes per second,
+// frames exceeding the budget are deferred, on the following ECMTx()
+// invocations, until enough time has elapsed. A zero rate disables shaping.
+func (eth *NIC) SetTxRate(bytesPerSec int) error {
+	if bytesPerSec < 0 {
+		return errors.New("invalid rate")
+	}
+
+	eth.shaper.Lock()
+	defer eth.shaper.Unlock()
+
+	eth.shaper.rate = int64(bytesPerSec)
+	eth.shaper.tokens = 0
+	eth.shaper.last = time.Now()
+
+	return nil
+}
+
+// TxShapingStats returns the transmit shaping counters.
+func (eth *NIC) TxShapingStats() TxShapingStats {
+	return TxShapingStats{
+		DeferredFrames: eth.shaper.deferredFrames.Load(),
+		DeferredBytes:  eth.shaper.deferredBytes.Load(),
+	}
+}
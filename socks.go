@@ -0,0 +1,192 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion = 0x05
+
+	socksMethodNone         = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAtypNotSupported    = 0x08
+)
+
+// socksHandshakeTimeout represents the maximum duration for a SOCKS client to
+// complete its request.
+const socksHandshakeTimeout = 10 * time.Second
+
+// DialFunc represents a function to establish outbound connections.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// socksReply sends a SOCKS5 reply, with an unspecified bound address.
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksRequest negotiates the authentication method and reads a SOCKS5
+// request, returning the requested command and destination address.
+func socksRequest(conn net.Conn) (cmd byte, address string, err error) {
+	buf := make([]byte, 255)
+
+	// version, number of methods
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+
+	if buf[0] != socksVersion {
+		return 0, "", errors.New("unsupported SOCKS version")
+	}
+
+	methods := buf[:buf[1]]
+
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	method := byte(socksMethodNoAcceptable)
+
+	for _, m := range methods {
+		if m == socksMethodNone {
+			method = socksMethodNone
+		}
+	}
+
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil {
+		return
+	}
+
+	if method == socksMethodNoAcceptable {
+		return 0, "", errors.New("no acceptable authentication method")
+	}
+
+	// version, command, reserved, address type
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+
+	if buf[0] != socksVersion {
+		return 0, "", errors.New("unsupported SOCKS version")
+	}
+
+	cmd = buf[1]
+
+	var host string
+
+	switch buf[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+
+		if buf[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return
+		}
+
+		host = ip.String()
+	case socksAtypDomain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+
+		name := buf[:buf[0]]
+
+		if _, err = io.ReadFull(conn, name); err != nil {
+			return
+		}
+
+		host = string(name)
+	default:
+		socksReply(conn, socksAtypNotSupported)
+		return 0, "", errors.New("unsupported address type")
+	}
+
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+
+	port := binary.BigEndian.Uint16(buf[:2])
+	address = net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	return
+}
+
+// handleSOCKS serves a single SOCKS5 client connection.
+func (iface *Interface) handleSOCKS(ctx context.Context, conn net.Conn, dial DialFunc) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	cmd, address, err := socksRequest(conn)
+
+	if err != nil {
+		return
+	}
+
+	if cmd != socksCmdConnect {
+		socksReply(conn, socksCommandNotSupported)
+		return
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, socksHandshakeTimeout)
+	defer cancel()
+
+	remote, err := dial(dctx, "tcp", address)
+
+	if err != nil {
+		socksReply(conn, socksHostUnreachable)
+		return
+	}
+
+	if err = socksReply(conn, socksSucceeded); err != nil {
+		remote.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	iface.Splice(conn, remote)
+}
+
+// ServeSOCKS runs a SOCKS5 (RFC 1928) proxy, until ctx is cancelled, accepting
+// clients on the argument port and establishing their outbound connections
+// through the argument dial function (e.g. a net.Dialer DialContext()
+// function on another interface).
+//
+// Only the CONNECT command and the "no authentication required" method are
+// supported, other requests are refused with the relevant error reply.
+func (iface *Interface) ServeSOCKS(ctx context.Context, port uint16, dial DialFunc) error {
+	if dial == nil {
+		return errors.New("missing dial function")
+	}
+
+	return iface.ServeTCP(ctx, port, func(conn net.Conn) {
+		iface.handleSOCKS(ctx, conn, dial)
+	})
+}
@@ -0,0 +1,178 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// stateVersion represents the ExportState() serialization format version.
+const stateVersion = 1
+
+// state represents the learned network state serialized by ExportState().
+type state struct {
+	Version   int
+	DeviceMAC string
+	DeviceIP  string
+	HostMAC   string
+	HostIP    string
+}
+
+// learn records the host addresses from a received ARP frame sender fields.
+//
+// IPv4 source addresses are not considered as the host may route or forward
+// traffic over the link on behalf of remote addresses. IPv6 neighbor
+// discovery is not considered either.
+func (eth *NIC) learn(frame []byte) {
+	if binary.BigEndian.Uint16(frame[12:14]) != uint16(header.ARPProtocolNumber) {
+		return
+	}
+
+	arp := header.ARP(frame[14:])
+
+	if !arp.IsValid() {
+		return
+	}
+
+	ip := net.IP(arp.ProtocolAddressSender())
+	mac := net.HardwareAddr(arp.HardwareAddressSender())
+
+	if ip.IsUnspecified() {
+		return
+	}
+
+	eth.mu.Lock()
+	defer eth.mu.Unlock()
+
+	if !ip.Equal(eth.hostIP) || !bytes.Equal(mac, eth.hostMAC) {
+		eth.hostIP = append(net.IP{}, ip...)
+		eth.hostMAC = append(net.HardwareAddr{}, mac...)
+	}
+}
+
+// Host returns the host IPv4 and MAC addresses learned from received ARP
+// frames, or imported with Interface.ImportState(), nil values are returned if not
+// yet known.
+func (eth *NIC) Host() (ip net.IP, mac net.HardwareAddr) {
+	eth.mu.Lock()
+	defer eth.mu.Unlock()
+
+	return eth.hostIP, eth.hostMAC
+}
+
+// ExportState serializes the learned network state (host MAC and IPv4
+// addresses, device IPv4 address), meant to be stored by firmware and
+// restored with ImportState() across reboots for faster bring-up.
+func (iface *Interface) ExportState() ([]byte, error) {
+	if iface.NIC == nil {
+		return nil, errors.New("interface not initialized")
+	}
+
+	hostIP, hostMAC := iface.NIC.Host()
+
+	if hostIP == nil {
+		return nil, errors.New("no learned state")
+	}
+
+	return json.Marshal(&state{
+		Version:   stateVersion,
+		DeviceMAC: iface.NIC.DeviceMAC.String(),
+		DeviceIP:  iface.addr.String(),
+		HostMAC:   hostMAC.String(),
+		HostIP:    hostIP.String(),
+	})
+}
+
+// ImportState restores the network state previously serialized with
+// ExportState(), it must be invoked after Init() and before any service is
+// started or connection dialed, as the device address is replaced without
+// synchronization with its users.
+//
+// The device IPv4 address is replaced if different from the current one and
+// the host addresses are restored (see NIC.Host()). No neighbor entry is
+// seeded, as the link does not perform address resolution and always
+// addresses frames to NIC.HostMAC. An error is returned, leaving the
+// interface unchanged, if the data is invalid or belongs to a different
+// device or host MAC than the configured ones.
+func (iface *Interface) ImportState(buf []byte) (err error) {
+	var s state
+
+	if iface.NIC == nil {
+		return errors.New("interface not initialized")
+	}
+
+	if err = json.Unmarshal(buf, &s); err != nil {
+		return
+	}
+
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+
+	deviceMAC, err := net.ParseMAC(s.DeviceMAC)
+
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(deviceMAC, iface.NIC.DeviceMAC) {
+		return errors.New("state device MAC mismatch")
+	}
+
+	hostMAC, err := net.ParseMAC(s.HostMAC)
+
+	if err != nil || len(hostMAC) != 6 {
+		return errors.New("invalid state host MAC")
+	}
+
+	// frames are always addressed to the configured host MAC, a state
+	// learned from a different host is stale
+	if !bytes.Equal(hostMAC, iface.NIC.HostMAC) {
+		return errors.New("state host MAC mismatch")
+	}
+
+	hostIP := net.ParseIP(s.HostIP).To4()
+	deviceIP := net.ParseIP(s.DeviceIP).To4()
+
+	if hostIP == nil || deviceIP == nil {
+		return errors.New("invalid state IP address")
+	}
+
+	if addr := tcpip.AddrFromSlice(deviceIP); addr != iface.addr {
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: addr.WithPrefix(),
+		}
+
+		if err := iface.Stack.AddProtocolAddress(iface.NICID, protocolAddr, stack.AddressProperties{}); err != nil {
+			return fmt.Errorf("%v", err)
+		}
+
+		iface.Stack.RemoveAddress(iface.NICID, iface.addr)
+		iface.addr = addr
+	}
+
+	iface.NIC.mu.Lock()
+	defer iface.NIC.mu.Unlock()
+
+	iface.NIC.hostIP = hostIP
+	iface.NIC.hostMAC = hostMAC
+
+	return
+}
@@ -0,0 +1,87 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// arpRequest returns an ARP request frame from the host for the device
+// address.
+func arpRequest(iface *Interface) []byte {
+	frame := make([]byte, header.EthernetMinimumSize+header.ARPSize)
+
+	copy(frame[0:6], iface.NIC.DeviceMAC)
+	copy(frame[6:12], iface.NIC.HostMAC)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(header.ARPProtocolNumber))
+
+	arp := header.ARP(frame[header.EthernetMinimumSize:])
+	arp.SetIPv4OverEthernet()
+	arp.SetOp(header.ARPRequest)
+	copy(arp.HardwareAddressSender(), iface.NIC.HostMAC)
+	copy(arp.ProtocolAddressSender(), net.ParseIP(testHostIP).To4())
+	copy(arp.ProtocolAddressTarget(), net.ParseIP(testDeviceIP).To4())
+
+	return frame
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	iface := newTestInterface(t)
+
+	if err := iface.NIC.ReplayFrames([][]byte{arpRequest(iface)}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := iface.ExportState()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &Interface{}
+
+	if err := restored.Init("10.0.0.3", testDeviceMAC, testHostMAC); err != nil {
+		t.Fatal(err)
+	}
+
+	defer restored.Close()
+
+	if err := restored.ImportState(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := restored.addr.String(); addr != testDeviceIP {
+		t.Fatalf("device address %s, want %s", addr, testDeviceIP)
+	}
+
+	if ip, mac := restored.NIC.Host(); ip.String() != testHostIP || mac.String() != testHostMAC {
+		t.Fatalf("host %s %s, want %s %s", ip, mac, testHostIP, testHostMAC)
+	}
+
+	// state learned from a different host
+	other := &Interface{}
+
+	if err := other.Init("10.0.0.3", testDeviceMAC, "1a:55:89:a2:69:43"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	if err := other.ImportState(buf); err == nil {
+		t.Fatal("state imported with host MAC mismatch")
+	}
+
+	if ip, _ := other.NIC.Host(); ip != nil || other.addr.String() != "10.0.0.3" {
+		t.Fatal("interface changed on host MAC mismatch")
+	}
+}
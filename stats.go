@@ -0,0 +1,114 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// ProtocolCounters represents frame counters broken down by EtherType and,
+// for IP packets, by transport protocol.
+type ProtocolCounters struct {
+	IPv4  uint64
+	IPv6  uint64
+	ARP   uint64
+	Other uint64
+
+	TCP  uint64
+	UDP  uint64
+	ICMP uint64
+}
+
+// ProtocolStats represents the received (Rx) and transmitted (Tx) per-protocol
+// frame counters.
+type ProtocolStats struct {
+	Rx ProtocolCounters
+	Tx ProtocolCounters
+}
+
+type protocolCounters struct {
+	ipv4  atomic.Uint64
+	ipv6  atomic.Uint64
+	arp   atomic.Uint64
+	other atomic.Uint64
+
+	tcp  atomic.Uint64
+	udp  atomic.Uint64
+	icmp atomic.Uint64
+}
+
+// count categorizes an Ethernet frame, only the EtherType and IP protocol
+// fields are inspected.
+func (c *protocolCounters) count(frame []byte) {
+	var proto uint8
+
+	if len(frame) < header.EthernetMinimumSize {
+		return
+	}
+
+	payload := frame[header.EthernetMinimumSize:]
+
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case uint16(header.IPv4ProtocolNumber):
+		c.ipv4.Add(1)
+
+		if len(payload) < header.IPv4MinimumSize {
+			return
+		}
+
+		proto = header.IPv4(payload).Protocol()
+	case uint16(header.IPv6ProtocolNumber):
+		c.ipv6.Add(1)
+
+		if len(payload) < header.IPv6MinimumSize {
+			return
+		}
+
+		proto = header.IPv6(payload).NextHeader()
+	case uint16(header.ARPProtocolNumber):
+		c.arp.Add(1)
+		return
+	default:
+		c.other.Add(1)
+		return
+	}
+
+	switch proto {
+	case uint8(header.TCPProtocolNumber):
+		c.tcp.Add(1)
+	case uint8(header.UDPProtocolNumber):
+		c.udp.Add(1)
+	case uint8(header.ICMPv4ProtocolNumber), uint8(header.ICMPv6ProtocolNumber):
+		c.icmp.Add(1)
+	}
+}
+
+func (c *protocolCounters) load() ProtocolCounters {
+	return ProtocolCounters{
+		IPv4:  c.ipv4.Load(),
+		IPv6:  c.ipv6.Load(),
+		ARP:   c.arp.Load(),
+		Other: c.other.Load(),
+		TCP:   c.tcp.Load(),
+		UDP:   c.udp.Load(),
+		ICMP:  c.icmp.Load(),
+	}
+}
+
+// ProtocolStats returns the per-protocol counters of frames received from,
+// and transmitted to, the host.
+func (eth *NIC) ProtocolStats() ProtocolStats {
+	return ProtocolStats{
+		Rx: eth.rxProtocols.load(),
+		Tx: eth.txProtocols.load(),
+	}
+}
@@ -0,0 +1,171 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// TCPOptions represents TCP endpoint options, applied before connection
+// establishment so that they are reflected in the initial handshake.
+type TCPOptions struct {
+	// SendBufferSize is the endpoint send buffer size (SO_SNDBUF) in
+	// bytes, the stack default is used if zero.
+	SendBufferSize int
+
+	// ReceiveBufferSize is the endpoint receive buffer size (SO_RCVBUF)
+	// in bytes, the stack default is used if zero. As it determines the
+	// advertised window scale, it is only effective before connection
+	// establishment.
+	ReceiveBufferSize int
+
+	// WindowClamp bounds the advertised receive window in bytes, it is
+	// enforced by sizing the receive buffer to twice its value (gVisor
+	// advertises half of the receive buffer), therefore it cannot be
+	// combined with ReceiveBufferSize. It overrides receive buffer
+	// auto-tuning for the connection, which is useful to reproduce slow
+	// receiver scenarios.
+	WindowClamp int
+}
+
+// listenBacklog represents the listening endpoint backlog, matching
+// gonet.ListenTCP().
+const listenBacklog = 4096
+
+// apply sets the options on a TCP endpoint, the buffer sizes are validated
+// against the stack configured ranges (see tcpip.TCPSendBufferSizeRangeOption
+// and tcpip.TCPReceiveBufferSizeRangeOption).
+func (opts *TCPOptions) apply(ep tcpip.Endpoint) error {
+	so := ep.SocketOptions()
+	rcvBuf := opts.ReceiveBufferSize
+
+	if opts.WindowClamp != 0 {
+		if opts.WindowClamp < 0 || rcvBuf != 0 {
+			return errors.New("invalid window clamp")
+		}
+
+		rcvBuf = opts.WindowClamp << 1
+	}
+
+	if n := int64(opts.SendBufferSize); n != 0 {
+		if lo, hi := so.SendBufferLimits(); n < lo || n > hi {
+			return fmt.Errorf("send buffer size %d outside of range [%d, %d]", n, lo, hi)
+		}
+
+		so.SetSendBufferSize(n, true)
+	}
+
+	if n := int64(rcvBuf); n != 0 {
+		if lo, hi := so.ReceiveBufferLimits(); n < lo || n > hi {
+			return fmt.Errorf("receive buffer size %d outside of range [%d, %d]", n, lo, hi)
+		}
+
+		so.SetReceiveBufferSize(n, true)
+	}
+
+	return nil
+}
+
+// DialContextTCP4WithOptions connects to an IPv4 TCP address, with support
+// for timeout supplied by ctx, applying the argument options before the
+// connection is established.
+func (iface *Interface) DialContextTCP4WithOptions(ctx context.Context, address string, opts TCPOptions) (net.Conn, error) {
+	var wq waiter.Queue
+
+	if iface.linkDown() {
+		return nil, ErrLinkDown
+	}
+
+	fullAddr, err := fullAddr(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ep, tcpipErr := iface.Stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if tcpipErr != nil {
+		return nil, fmt.Errorf("endpoint error (tcp): %v", tcpipErr)
+	}
+
+	if err = opts.apply(ep); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	entry, notify := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&entry)
+	defer wq.EventUnregister(&entry)
+
+	tcpipErr = ep.Connect(fullAddr)
+
+	if _, ok := tcpipErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notify:
+		}
+
+		tcpipErr = ep.LastError()
+	}
+
+	if tcpipErr != nil {
+		ep.Close()
+		return nil, fmt.Errorf("connect error (%s): %v", address, tcpipErr)
+	}
+
+	return (net.Conn)(gonet.NewTCPConn(&wq, ep)), nil
+}
+
+// ListenerTCP4WithOptions returns a net.Listener capable of accepting IPv4 TCP
+// connections for the argument port, applying the argument options to the
+// listening endpoint. Accepted connections inherit the receive buffer size
+// (and therefore window clamp) but not the send buffer size.
+func (iface *Interface) ListenerTCP4WithOptions(port uint16, opts TCPOptions) (net.Listener, error) {
+	var wq waiter.Queue
+
+	if iface.protocol() != ipv4.ProtocolNumber {
+		return nil, ErrNoIPv4
+	}
+
+	ep, tcpipErr := iface.Stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if tcpipErr != nil {
+		return nil, fmt.Errorf("endpoint error (tcp): %v", tcpipErr)
+	}
+
+	if err := opts.apply(ep); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	fullAddr := tcpip.FullAddress{Addr: iface.addr, Port: port, NIC: iface.NICID}
+
+	if tcpipErr = ep.Bind(fullAddr); tcpipErr != nil {
+		ep.Close()
+		return nil, fmt.Errorf("bind error (tcp endpoint): %v", tcpipErr)
+	}
+
+	if tcpipErr = ep.Listen(listenBacklog); tcpipErr != nil {
+		ep.Close()
+		return nil, fmt.Errorf("listen error (tcp endpoint): %v", tcpipErr)
+	}
+
+	return (net.Listener)(gonet.NewTCPListener(iface.Stack, &wq, ep)), nil
+}
@@ -0,0 +1,51 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+func TestTCPOptionsRange(t *testing.T) {
+	var wq waiter.Queue
+
+	iface := newTestInterface(t)
+	ep, err := iface.Stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	so := ep.SocketOptions()
+	sndLo, sndHi := so.SendBufferLimits()
+	rcvLo, rcvHi := so.ReceiveBufferLimits()
+
+	for _, test := range []struct {
+		opts  TCPOptions
+		valid bool
+	}{
+		{TCPOptions{SendBufferSize: int(sndLo)}, true},
+		{TCPOptions{SendBufferSize: int(sndHi)}, true},
+		{TCPOptions{SendBufferSize: int(sndLo) - 1}, false},
+		{TCPOptions{SendBufferSize: int(sndHi) + 1}, false},
+		{TCPOptions{ReceiveBufferSize: int(rcvLo)}, true},
+		{TCPOptions{ReceiveBufferSize: int(rcvHi)}, true},
+		{TCPOptions{ReceiveBufferSize: int(rcvLo) - 1}, false},
+		{TCPOptions{ReceiveBufferSize: int(rcvHi) + 1}, false},
+	} {
+		if err := test.opts.apply(ep); (err == nil) != test.valid {
+			t.Errorf("apply(%+v) error = %v", test.opts, err)
+		}
+	}
+}
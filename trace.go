@@ -0,0 +1,72 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+)
+
+// TraceFunc represents a printf-like function (e.g. log.Printf) to emit
+// diagnostic messages.
+type TraceFunc func(format string, v ...any)
+
+// standardResponse returns the data sent by the standard setup handlers in
+// response to descriptor requests, which are not visible to setup functions.
+func standardResponse(device *usb.Device, setup *usb.SetupData) (buf []byte) {
+	if setup.Request != usb.GET_DESCRIPTOR {
+		return
+	}
+
+	index := setup.Value >> 8
+
+	switch setup.Value & 0xff {
+	case usb.DEVICE:
+		buf = device.Descriptor.Bytes()
+	case usb.CONFIGURATION, usb.OTHER_SPEED_CONFIGURATION:
+		buf, _ = device.Configuration(index)
+	case usb.STRING:
+		if int(index) < len(device.Strings) {
+			buf = device.Strings[index]
+		}
+	case usb.DEVICE_QUALIFIER:
+		buf = device.Qualifier.Bytes()
+	}
+
+	if len(buf) > int(setup.Length) {
+		buf = buf[:setup.Length]
+	}
+
+	return
+}
+
+// trace emits the argument setup request and the response given to it,
+// either by the chained setup function or by the standard setup handlers.
+func (eth *NIC) trace(setup *usb.SetupData, in []byte, ack bool, done bool, err error) {
+	eth.Trace("usbnet: setup bmRequestType:%#02x bRequest:%d wValue:%#04x wIndex:%d wLength:%d",
+		setup.RequestType, setup.Request, setup.Value, setup.Index, setup.Length)
+
+	switch {
+	case err != nil:
+		eth.Trace("usbnet: setup stall, %v", err)
+	case len(in) != 0:
+		eth.Trace("usbnet: setup in (%d bytes): % x", len(in), in)
+	case ack:
+		eth.Trace("usbnet: setup ack")
+	}
+
+	if done || err != nil {
+		return
+	}
+
+	if buf := standardResponse(eth.Device, setup); buf != nil {
+		eth.Trace("usbnet: setup standard in (%d bytes): % x", len(buf), buf)
+	} else if setup.Request == usb.GET_DESCRIPTOR {
+		eth.Trace("usbnet: setup standard stall, unsupported descriptor")
+	}
+}
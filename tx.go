@@ -0,0 +1,58 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+// txQueue sequences the frames handed to the USB layer by ECMTx(), it holds
+// the frame of the transfer in progress, to retransmit it on failure, and any
+// frame deferred as not yet admitted for transmission.
+type txQueue struct {
+	pending  []byte
+	retried  bool
+	deferred []byte
+}
+
+// next returns the frame for the following transfer, given the error of the
+// previous one, along with the previous frame if its transfer succeeded.
+//
+// A frame whose transfer failed is returned once more in its entirety, a
+// second failure drops it. Otherwise the deferred frame, or a new one obtained
+// from read, is returned if admitted by allow or deferred to the following
+// invocation. The held argument passed to allow reports whether the frame was
+// previously deferred.
+func (q *txQueue) next(lastErr error, read func() []byte, allow func(frame []byte, held bool) bool) (in []byte, sent []byte) {
+	if q.pending != nil {
+		switch {
+		case lastErr == nil:
+			sent = q.pending
+		case !q.retried:
+			q.retried = true
+			return q.pending, nil
+		}
+	}
+
+	q.pending = nil
+	q.retried = false
+
+	held := q.deferred != nil
+
+	if in, q.deferred = q.deferred, nil; in == nil {
+		if in = read(); in == nil {
+			return
+		}
+	}
+
+	if !allow(in, held) {
+		q.deferred = in
+		return nil, sent
+	}
+
+	q.pending = in
+
+	return
+}
@@ -0,0 +1,166 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+)
+
+var errTransfer = errors.New("transfer error")
+
+// frames returns a txQueue read function yielding the argument frames.
+func frames(f ...[]byte) func() []byte {
+	return func() (in []byte) {
+		if len(f) > 0 {
+			in, f = f[0], f[1:]
+		}
+
+		return
+	}
+}
+
+func admitAll([]byte, bool) bool {
+	return true
+}
+
+func checkNext(t *testing.T, q *txQueue, lastErr error, read func() []byte, in []byte, sent []byte) {
+	t.Helper()
+
+	gotIn, gotSent := q.next(lastErr, read, admitAll)
+
+	if !bytes.Equal(gotIn, in) || !bytes.Equal(gotSent, sent) {
+		t.Fatalf("next(%v) = %q, %q, want %q, %q", lastErr, gotIn, gotSent, in, sent)
+	}
+}
+
+func TestTxRetransmit(t *testing.T) {
+	var q txQueue
+
+	a, b := []byte("a"), []byte("b")
+	read := frames(a, b)
+
+	checkNext(t, &q, nil, read, a, nil)
+	checkNext(t, &q, errTransfer, read, a, nil)
+	checkNext(t, &q, nil, read, b, a)
+	checkNext(t, &q, nil, read, nil, b)
+}
+
+func TestTxDropOnSecondFailure(t *testing.T) {
+	var q txQueue
+
+	a, b := []byte("a"), []byte("b")
+	read := frames(a, b)
+
+	checkNext(t, &q, nil, read, a, nil)
+	checkNext(t, &q, errTransfer, read, a, nil)
+	checkNext(t, &q, errTransfer, read, b, nil)
+	checkNext(t, &q, errTransfer, read, b, nil)
+	checkNext(t, &q, errTransfer, read, nil, nil)
+}
+
+func TestTxDeferred(t *testing.T) {
+	var q txQueue
+	var held []bool
+
+	a := []byte("a")
+	read := frames(a)
+
+	allow := func(_ []byte, h bool) bool {
+		held = append(held, h)
+		return len(held) == 3
+	}
+
+	for i := 0; i < 3; i++ {
+		in, _ := q.next(nil, read, allow)
+
+		if admitted := i == 2; admitted != (in != nil) {
+			t.Fatalf("invocation %d returned %q", i, in)
+		}
+	}
+
+	if held[0] || !held[1] || !held[2] {
+		t.Fatalf("unexpected held sequence %v", held)
+	}
+
+	if in, sent := q.next(nil, read, admitAll); in != nil || !bytes.Equal(sent, a) {
+		t.Fatalf("deferred frame not confirmed, got %q, %q", in, sent)
+	}
+}
+
+// TestECMTxConstrainedEndpoint simulates an endpoint failing the first
+// transfer of every frame, each frame must reach the host whole, exactly once
+// and in order, with only confirmed transfers accounted.
+func TestECMTxConstrainedEndpoint(t *testing.T) {
+	eth := &NIC{
+		HostMAC:   net.HardwareAddr{0x1a, 0x55, 0x89, 0xa2, 0x69, 0x42},
+		DeviceMAC: net.HardwareAddr{0x1a, 0x55, 0x89, 0xa2, 0x69, 0x41},
+		Link:      channel.New(QueueSize, MTU, ""),
+		raw:       make(chan []byte, QueueSize),
+	}
+
+	var want [][]byte
+	var size uint64
+
+	for i := 0; i < 8; i++ {
+		frame := append(append([]byte{}, eth.HostMAC...), eth.DeviceMAC...)
+		frame = append(frame, 0x88, 0xb5)
+		frame = append(frame, bytes.Repeat([]byte{byte(i)}, 1+i*100)...)
+
+		if err := eth.SendRaw(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		want = append(want, frame)
+		size += uint64(len(frame))
+	}
+
+	var received [][]byte
+	var lastErr error
+	var last []byte
+
+	for i := 0; i < 2*len(want)+1; i++ {
+		in, err := eth.ECMTx(nil, lastErr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// fail every first attempt, succeed on retransmission
+		if in != nil && !bytes.Equal(in, last) {
+			lastErr = errTransfer
+		} else {
+			lastErr = nil
+
+			if in != nil {
+				received = append(received, in)
+			}
+		}
+
+		last = in
+	}
+
+	if len(received) != len(want) {
+		t.Fatalf("received %d frames, want %d", len(received), len(want))
+	}
+
+	for i := range want {
+		if !bytes.Equal(received[i], want[i]) {
+			t.Fatalf("frame %d mismatch", i)
+		}
+	}
+
+	if n := eth.TxBytes(); n != size {
+		t.Fatalf("TxBytes() = %d, want %d", n, size)
+	}
+}
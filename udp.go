@@ -0,0 +1,244 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// UDPQueueSize represents the default number of received datagrams queued by
+// UDP listeners (see ListenerUDP4()).
+var UDPQueueSize = 64
+
+// datagram represents a received UDP datagram.
+type datagram struct {
+	buf  []byte
+	addr net.Addr
+}
+
+// UDPListener represents a UDP listener with a bounded queue of received
+// datagrams, filled independently from the pace of ReadFrom() invocations.
+//
+// When the queue is full newly received datagrams are dropped, and counted,
+// rather than having memory usage grow under floods.
+type UDPListener struct {
+	net.PacketConn
+
+	queue   chan datagram
+	done    chan struct{}
+	err     error
+	dropped atomic.Uint64
+
+	mu       sync.Mutex
+	closed   bool
+	deadline chan struct{}
+	timer    *time.Timer
+	gen      uint64
+}
+
+// ListenerUDP returns a UDP listener capable of receiving and transmitting
+// UDP datagrams on the argument port, on the address family of the interface
+// address, queueing up to UDPQueueSize received datagrams.
+func (iface *Interface) ListenerUDP(port uint16) (*UDPListener, error) {
+	return iface.listenerUDP(port, UDPQueueSize)
+}
+
+// ListenerUDP4 returns a net.PacketConn capable of receiving and transmitting
+// IPv4 UDP datagrams on the argument port, the underlying *UDPListener queues
+// up to UDPQueueSize received datagrams (see ListenerUDP4Queue()).
+func (iface *Interface) ListenerUDP4(port uint16) (net.PacketConn, error) {
+	l, err := iface.ListenerUDP4Queue(port, UDPQueueSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return (net.PacketConn)(l), nil
+}
+
+// ListenerUDP4Queue returns a UDP listener capable of receiving and
+// transmitting IPv4 UDP datagrams on the argument port, queueing up to depth
+// received datagrams.
+func (iface *Interface) ListenerUDP4Queue(port uint16, depth int) (*UDPListener, error) {
+	if iface.protocol() != ipv4.ProtocolNumber {
+		return nil, ErrNoIPv4
+	}
+
+	return iface.listenerUDP(port, depth)
+}
+
+func (iface *Interface) listenerUDP(port uint16, depth int) (*UDPListener, error) {
+	if depth <= 0 {
+		return nil, errors.New("invalid queue depth")
+	}
+
+	fullAddr := tcpip.FullAddress{Addr: iface.addr, Port: port, NIC: iface.NICID}
+	conn, err := gonet.DialUDP(iface.Stack, &fullAddr, nil, iface.protocol())
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := &UDPListener{
+		PacketConn: conn,
+		queue:      make(chan datagram, depth),
+		done:       make(chan struct{}),
+		deadline:   make(chan struct{}),
+	}
+
+	go l.receive()
+
+	return l, nil
+}
+
+// receive moves received datagrams to the queue until the listener is
+// closed.
+func (l *UDPListener) receive() {
+	buf := make([]byte, header.UDPMaximumSize)
+
+	for {
+		n, addr, err := l.PacketConn.ReadFrom(buf)
+
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+
+		select {
+		case l.queue <- datagram{append([]byte{}, buf[:n]...), addr}:
+		default:
+			l.dropped.Add(1)
+		}
+	}
+}
+
+// ReadFrom reads a queued datagram, see net.PacketConn.
+func (l *UDPListener) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	l.mu.Lock()
+	closed := l.closed
+	deadline := l.deadline
+	l.mu.Unlock()
+
+	// drain queued datagrams before reporting errors, closure takes
+	// precedence over an expired deadline
+	select {
+	case d := <-l.queue:
+		return copy(p, d.buf), d.addr, nil
+	default:
+	}
+
+	if closed {
+		return 0, nil, net.ErrClosed
+	}
+
+	select {
+	case <-l.done:
+		return 0, nil, l.closeErr()
+	default:
+	}
+
+	select {
+	case d := <-l.queue:
+		return copy(p, d.buf), d.addr, nil
+	case <-l.done:
+		return 0, nil, l.closeErr()
+	case <-deadline:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// closeErr returns the error reported once the receive goroutine stopped.
+func (l *UDPListener) closeErr() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return net.ErrClosed
+	}
+
+	return l.err
+}
+
+// Close implements net.PacketConn.Close, ReadFrom() invocations fail with
+// net.ErrClosed once queued datagrams are drained.
+func (l *UDPListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+
+	return l.PacketConn.Close()
+}
+
+// SetDeadline implements net.PacketConn.SetDeadline.
+func (l *UDPListener) SetDeadline(t time.Time) error {
+	l.SetReadDeadline(t)
+	return l.PacketConn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.SetReadDeadline.
+func (l *UDPListener) SetReadDeadline(t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+
+	// invalidate any expired timer still pending execution
+	l.gen++
+
+	select {
+	case <-l.deadline:
+		l.deadline = make(chan struct{})
+	default:
+	}
+
+	if t.IsZero() {
+		return nil
+	}
+
+	gen := l.gen
+
+	if d := time.Until(t); d <= 0 {
+		close(l.deadline)
+	} else {
+		l.timer = time.AfterFunc(d, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			if l.gen == gen {
+				close(l.deadline)
+			}
+		})
+	}
+
+	return nil
+}
+
+// Depth returns the listener queue depth.
+func (l *UDPListener) Depth() int {
+	return cap(l.queue)
+}
+
+// Dropped returns the number of datagrams dropped due to a full queue.
+func (l *UDPListener) Dropped() uint64 {
+	return l.dropped.Load()
+}
@@ -0,0 +1,54 @@
+// Ethernet over USB driver
+//
+// Copyright (c) WithSecure Corporation
+// https://foundry.withsecure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbnet
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPListenerClose(t *testing.T) {
+	iface := newTestInterface(t)
+
+	l, err := iface.ListenerUDP(5353)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	res := make(chan error, 1)
+
+	go func() {
+		_, _, err := l.ReadFrom(buf)
+		res <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+
+	if err := <-res; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("pending ReadFrom() error = %v, want net.ErrClosed", err)
+	}
+
+	// expired deadline right after Close(), before the receive goroutine
+	// observes the closure
+	if l, err = iface.ListenerUDP(5354); err != nil {
+		t.Fatal(err)
+	}
+
+	l.SetReadDeadline(time.Now().Add(-time.Second))
+	l.Close()
+
+	if _, _, err := l.ReadFrom(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("ReadFrom() error = %v, want net.ErrClosed", err)
+	}
+}
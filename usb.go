@@ -9,6 +9,8 @@
 package usbnet
 
 import (
+	"errors"
+	"net"
 	"strings"
 
 	"github.com/usbarmory/tamago/soc/nxp/usb"
@@ -17,7 +19,71 @@ import (
 // MaxPacketSize represents the USB data interface endpoint maximum packet size
 var MaxPacketSize uint16 = 512
 
+// Profile represents a set of USB descriptor adjustments, applied by
+// ConfigureDeviceProfile() and NIC.Init(), to maximize compatibility with a
+// specific host OS.
+type Profile struct {
+	// IAD wraps the ECM function in an Interface Association Descriptor
+	// and sets the device class to Miscellaneous (0xef/0x02/0x01), which
+	// is required for composite devices. When false no IAD is inserted
+	// and the device class is set to Communications (0x02).
+	IAD bool
+
+	// UppercaseMAC formats the iMACAddress string descriptor with
+	// uppercase hexadecimal digits, as mandated by the CDC ECM
+	// specification (p16, Table 3, ECM120), rather than lowercase ones.
+	UppercaseMAC bool
+
+	// OmitMACAddress leaves the Ethernet Networking Functional Descriptor
+	// iMACAddress index to zero, rather than pointing it to the host MAC
+	// string descriptor.
+	//
+	// The iMACAddress string is mandatory in the CDC ECM specification and
+	// required by Linux (cdc_ether) and macOS hosts, which fail to bind
+	// the interface in its absence. Omitting it is only meant for minimal
+	// hosts (e.g. embedded USB host stacks) failing to enumerate the device
+	// when fetching it.
+	OmitMACAddress bool
+}
+
+var (
+	// DefaultProfile represents the default, spec compliant, descriptor
+	// profile which is broadly compatible with Linux and macOS hosts.
+	DefaultProfile = Profile{
+		IAD:          true,
+		UppercaseMAC: true,
+	}
+
+	// LegacyProfile differs from DefaultProfile by reporting a lowercase
+	// iMACAddress, as accepted by the Linux cdc_ether driver, to match
+	// descriptors generated by earlier package versions.
+	LegacyProfile = Profile{
+		IAD: true,
+	}
+
+	// MacOSProfile differs from DefaultProfile by omitting the IAD and
+	// advertising the Communications device class, for hosts binding
+	// their CDC driver on the device class of single function devices.
+	// The profile cannot be used on composite devices.
+	MacOSProfile = Profile{
+		UppercaseMAC: true,
+	}
+)
+
+// macString returns the iMACAddress string descriptor value.
+func (p *Profile) macString(mac net.HardwareAddr) (s string) {
+	s = strings.ReplaceAll(mac.String(), ":", "")
+
+	if p.UppercaseMAC {
+		s = strings.ToUpper(s)
+	}
+
+	return
+}
+
 func addControlInterface(device *usb.Device, eth *NIC) (iface *usb.InterfaceDescriptor) {
+	profile := eth.Profile
+
 	iface = &usb.InterfaceDescriptor{}
 	iface.SetDefaults()
 
@@ -28,16 +94,18 @@ func addControlInterface(device *usb.Device, eth *NIC) (iface *usb.InterfaceDesc
 	iInterface, _ := device.AddString(`CDC Ethernet Control Model (ECM)`)
 	iface.Interface = iInterface
 
-	// Set IAD to be inserted before first interface, to support multiple
-	// functions in this same configuration.
-	iface.IAD = &usb.InterfaceAssociationDescriptor{}
-	iface.IAD.SetDefaults()
-	iface.IAD.InterfaceCount = 2
-	iface.IAD.FunctionClass = iface.InterfaceClass
-	iface.IAD.FunctionSubClass = iface.InterfaceSubClass
+	if profile.IAD {
+		// Set IAD to be inserted before first interface, to support
+		// multiple functions in this same configuration.
+		iface.IAD = &usb.InterfaceAssociationDescriptor{}
+		iface.IAD.SetDefaults()
+		iface.IAD.InterfaceCount = 2
+		iface.IAD.FunctionClass = iface.InterfaceClass
+		iface.IAD.FunctionSubClass = iface.InterfaceSubClass
 
-	iFunction, _ := device.AddString(`CDC`)
-	iface.IAD.Function = iFunction
+		iFunction, _ := device.AddString(`CDC`)
+		iface.IAD.Function = iFunction
+	}
 
 	header := &usb.CDCHeaderDescriptor{}
 	header.SetDefaults()
@@ -47,7 +115,7 @@ func addControlInterface(device *usb.Device, eth *NIC) (iface *usb.InterfaceDesc
 	union := &usb.CDCUnionDescriptor{}
 	union.SetDefaults()
 
-	numInterfaces := 1 + len(device.Configurations[0].Interfaces)
+	numInterfaces := 1 + len(device.Configurations[eth.ConfigurationIndex].Interfaces)
 	union.MasterInterface = uint8(numInterfaces - 1)
 	union.SlaveInterface0 = uint8(numInterfaces)
 
@@ -56,8 +124,10 @@ func addControlInterface(device *usb.Device, eth *NIC) (iface *usb.InterfaceDesc
 	ethernet := &usb.CDCEthernetDescriptor{}
 	ethernet.SetDefaults()
 
-	iMacAddress, _ := device.AddString(strings.ReplaceAll(eth.HostMAC.String(), ":", ""))
-	ethernet.MacAddress = iMacAddress
+	if !profile.OmitMACAddress {
+		iMacAddress, _ := device.AddString(profile.macString(eth.HostMAC))
+		ethernet.MacAddress = iMacAddress
+	}
 
 	iface.ClassDescriptors = append(iface.ClassDescriptors, ethernet.Bytes())
 
@@ -71,7 +141,7 @@ func addControlInterface(device *usb.Device, eth *NIC) (iface *usb.InterfaceDesc
 
 	iface.Endpoints = append(iface.Endpoints, ep2IN)
 
-	device.Configurations[0].AddInterface(iface)
+	device.Configurations[eth.ConfigurationIndex].AddInterface(iface)
 
 	return
 }
@@ -83,7 +153,8 @@ func addDataInterfaces(device *usb.Device, eth *NIC) {
 	iface0.NumEndpoints = 0
 	iface0.InterfaceClass = usb.DATA_INTERFACE_CLASS
 
-	device.Configurations[0].AddInterface(iface0)
+	device.Configurations[eth.ConfigurationIndex].AddInterface(iface0)
+	eth.dataInterface = iface0.InterfaceNumber
 
 	// CDC requires the use of a default interface setting with no
 	// endpoints to signal a deactivated state, an additional interface
@@ -118,7 +189,7 @@ func addDataInterfaces(device *usb.Device, eth *NIC) {
 
 	iface1.Endpoints = append(iface1.Endpoints, ep1OUT)
 
-	device.Configurations[0].AddInterface(iface1)
+	device.Configurations[eth.ConfigurationIndex].AddInterface(iface1)
 
 	eth.maxPacketSize = int(MaxPacketSize)
 
@@ -128,6 +199,42 @@ func addDataInterfaces(device *usb.Device, eth *NIC) {
 // ConfigureDevice configures a USB device with default descriptors for a CDC
 // Ethernet (ECM) device, suitable for Add().
 func ConfigureDevice(device *usb.Device, serial string) {
+	// a single profile cannot fail validation
+	ConfigureDeviceProfiles(device, serial, &DefaultProfile)
+}
+
+// ConfigureDeviceProfile configures a USB device with descriptors for a CDC
+// Ethernet (ECM) device adjusted according to the argument profile, suitable
+// for Add(). The same profile must be set on the Interface (or NIC) being
+// added to the device.
+func ConfigureDeviceProfile(device *usb.Device, serial string, profile *Profile) error {
+	return ConfigureDeviceProfiles(device, serial, profile)
+}
+
+// ConfigureDeviceProfiles configures a USB device with descriptors for a CDC
+// Ethernet (ECM) device with one configuration for each argument profile,
+// suitable for Add().
+//
+// Each configuration is meant to be populated by its own Interface (or NIC),
+// with independent MAC addresses and descriptors, by setting its
+// ConfigurationIndex and Profile accordingly. The host selects the active one
+// with SET_CONFIGURATION, which allows switching between layouts for
+// compatibility testing without reflashing. Only the NIC matching the active
+// configuration reports its link as up (see NIC.LinkUp()).
+//
+// As the device class depends on it, all profiles must share the same IAD
+// setting.
+func ConfigureDeviceProfiles(device *usb.Device, serial string, profiles ...*Profile) error {
+	if len(profiles) == 0 {
+		return errors.New("missing profile")
+	}
+
+	for _, profile := range profiles[1:] {
+		if profile.IAD != profiles[0].IAD {
+			return errors.New("profiles IAD setting mismatch")
+		}
+	}
+
 	// Supported Language Code Zero: English
 	device.SetLanguageCodes([]uint16{0x0409})
 
@@ -135,11 +242,16 @@ func ConfigureDevice(device *usb.Device, serial string) {
 	device.Descriptor = &usb.DeviceDescriptor{}
 	device.Descriptor.SetDefaults()
 
-	// p5, Table 1-1. Device Descriptor Using Class Codes for IAD,
-	// USB Interface Association Descriptor Device Class Code and Use Model.
-	device.Descriptor.DeviceClass = 0xef
-	device.Descriptor.DeviceSubClass = 0x02
-	device.Descriptor.DeviceProtocol = 0x01
+	if profiles[0].IAD {
+		// p5, Table 1-1. Device Descriptor Using Class Codes for IAD,
+		// USB Interface Association Descriptor Device Class Code and
+		// Use Model.
+		device.Descriptor.DeviceClass = 0xef
+		device.Descriptor.DeviceSubClass = 0x02
+		device.Descriptor.DeviceProtocol = 0x01
+	} else {
+		device.Descriptor.DeviceClass = usb.COMMUNICATION_DEVICE_CLASS
+	}
 
 	// http://pid.codes/1209/2702/
 	device.Descriptor.VendorId = 0x1209
@@ -156,13 +268,18 @@ func ConfigureDevice(device *usb.Device, serial string) {
 	iSerial, _ := device.AddString(serial)
 	device.Descriptor.SerialNumber = iSerial
 
-	conf := &usb.ConfigurationDescriptor{}
-	conf.SetDefaults()
+	for i := range profiles {
+		conf := &usb.ConfigurationDescriptor{}
+		conf.SetDefaults()
+		conf.ConfigurationValue = uint8(i + 1)
 
-	device.AddConfiguration(conf)
+		device.AddConfiguration(conf)
+	}
 
 	// device qualifier
 	device.Qualifier = &usb.DeviceQualifierDescriptor{}
 	device.Qualifier.SetDefaults()
 	device.Qualifier.NumConfigurations = uint8(len(device.Configurations))
+
+	return nil
 }